@@ -0,0 +1,98 @@
+// Command batch sends a JSONL file of process requests to a running server's
+// batch endpoint and writes the JSONL results, one per item as it finishes.
+//
+//	batch -in prompts.jsonl -out results.jsonl -concurrency 8
+//
+// It exits with status 1 if the batch couldn't run or any item failed.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "base URL of the server")
+	in := flag.String("in", "-", "JSONL file of requests, - for stdin")
+	out := flag.String("out", "-", "file to write the JSONL results to, - for stdout")
+	concurrency := flag.Int("concurrency", 0, "items to run at once; 0 uses the server's BATCH_CONCURRENCY")
+	flag.Parse()
+
+	input := os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatalf("Failed to open input: %v", err)
+		}
+		defer f.Close()
+		input = f
+	}
+	output := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create output: %v", err)
+		}
+		defer f.Close()
+		output = f
+	}
+
+	items, failed, err := run(*server, *concurrency, input, output)
+	if err != nil {
+		log.Fatalf("Batch failed: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "%d items, %d failed\n", items, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// run posts the batch and copies the results to w as they arrive, counting
+// the items and the failed ones.
+func run(server string, concurrency int, r io.Reader, w io.Writer) (int, int, error) {
+	u, err := url.JoinPath(server, "/api/batch")
+	if err != nil {
+		return 0, 0, err
+	}
+	if concurrency > 0 {
+		u += "?concurrency=" + strconv.Itoa(concurrency)
+	}
+
+	res, err := http.Post(u, "application/x-ndjson", r)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+		return 0, 0, fmt.Errorf("server answered %s: %s", res.Status, body)
+	}
+
+	var items, failed int
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		var result struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &result); err != nil {
+			return items, failed, fmt.Errorf("invalid result line: %w", err)
+		}
+		items++
+		if result.Status != "completed" {
+			failed++
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", sc.Bytes()); err != nil {
+			return items, failed, err
+		}
+	}
+	return items, failed, sc.Err()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	input := `{"message": "one"}` + "\n" + `{"message": "two"}` + "\n"
+	results := `{"line":1,"status":"completed","answer":"a"}` + "\n" +
+		`{"line":2,"status":"failed","error":"processing failed"}` + "\n"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "/api/batch", r.URL.Path)
+		require.Equal(t, "3", r.URL.Query().Get("concurrency"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, input, string(body))
+		fmt.Fprint(w, results)
+	}))
+	defer srv.Close()
+
+	var out strings.Builder
+	items, failed, err := run(srv.URL, 3, strings.NewReader(input), &out)
+	require.NoError(t, err)
+	require.Equal(t, 2, items)
+	require.Equal(t, 1, failed)
+	require.Equal(t, results, out.String())
+}
+
+func TestRun_Rejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.URL.RawQuery, "concurrency 0 leaves it to the server")
+		http.Error(w, "batch is empty", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	_, _, err := run(srv.URL, 0, strings.NewReader(""), io.Discard)
+	require.ErrorContains(t, err, "batch is empty")
+}
@@ -4,17 +4,29 @@ import (
 	"context"
 	"llmsse/internal/config"
 	"llmsse/internal/llm"
+	"llmsse/internal/pipeline"
+	"llmsse/internal/prompt"
 	"llmsse/internal/server"
 	"llmsse/internal/service"
+	"llmsse/internal/store"
+	"llmsse/internal/webhook"
+	"time"
 
 	"go.uber.org/zap"
 )
 
 type App struct {
-	Server *server.Server
-	Logger *zap.Logger
+	Server   *server.Server
+	Logger   *zap.Logger
+	handler  *server.Handler
+	prompts  *prompt.Dir
+	store    store.Store
+	webhooks *webhook.Sender
 }
 
+// maxMemoryConversations bounds the in-memory store used without STORE_PATH.
+const maxMemoryConversations = 10000
+
 func New(cfg *config.Config, logger *zap.Logger) *App {
 	var llmClient llm.Interface
 	if cfg.UseMockLLM {
@@ -25,13 +37,96 @@ func New(cfg *config.Config, logger *zap.Logger) *App {
 		llmClient = llm.NewClient(cfg.LLMKey, "gpt-4o", "https://api.openai.com", logger)
 	}
 
-	svc := service.NewService(llmClient, logger)
-	router := server.NewRouter(svc, logger)
+	policy, err := service.ParsePolicy(cfg.CompletionPolicy)
+	if err != nil {
+		logger.Fatal("Invalid COMPLETION_POLICY", zap.Error(err))
+	}
+
+	onTimeout, err := service.ParseTimeoutPolicy(cfg.AgentTimeoutPolicy)
+	if err != nil {
+		logger.Fatal("Invalid AGENT_TIMEOUT_POLICY", zap.Error(err))
+	}
+
+	var prompts prompt.Source = prompt.Builtin()
+	var promptsDir *prompt.Dir
+	if cfg.PromptsDir != "" {
+		promptsDir, err = prompt.OpenDir(cfg.PromptsDir, prompt.Builtin(), logger)
+		if err != nil {
+			logger.Fatal("Invalid PROMPTS_DIR", zap.Error(err))
+		}
+		logger.Info("Loaded prompt templates",
+			zap.String("path", cfg.PromptsDir),
+			zap.Strings("templates", promptsDir.Current().IDs()),
+		)
+		prompts = promptsDir
+	}
+
+	// Without a store path, messages are kept in memory for the most
+	// recently active conversations only
+	var st store.Store = store.NewMemory(maxMemoryConversations)
+	if cfg.StorePath != "" {
+		st, err = store.OpenSQLite(context.Background(), cfg.StorePath)
+		if err != nil {
+			logger.Fatal("Invalid STORE_PATH", zap.Error(err))
+		}
+		logger.Info("Opened message store", zap.String("path", cfg.StorePath))
+	}
+
+	svc := service.NewService(llmClient, logger,
+		service.WithPrompts(prompts),
+		service.WithStore(st),
+		service.WithHistoryTurns(cfg.HistoryTurns),
+		service.WithSchemaRepairs(cfg.SchemaRepairAttempts),
+		service.WithCompletionPolicy(policy),
+		service.WithTimeouts(service.Timeouts{
+			Agent:     cfg.AgentTimeout,
+			OnTimeout: onTimeout,
+			Combine:   cfg.CombineTimeout,
+		}),
+		service.WithAgentStreaming(cfg.StreamAgents),
+	)
+	routerOpts := []server.RouterOption{
+		server.WithRequestTimeout(cfg.RequestTimeout),
+		server.WithDisconnectGrace(cfg.StreamGracePeriod),
+		server.WithJobs(cfg.JobsMax, cfg.JobsTTL),
+		server.WithBatchConcurrency(cfg.BatchConcurrency),
+		server.WithStore(st),
+	}
+	var webhooks *webhook.Sender
+	if cfg.WebhookSecret != "" {
+		webhooks = webhook.New(cfg.WebhookSecret, logger,
+			webhook.WithRetries(cfg.WebhookMaxAttempts, time.Second, time.Minute),
+			webhook.WithDeadLetterFile(cfg.WebhookDeadLetterPath),
+		)
+		routerOpts = append(routerOpts, server.WithWebhooks(webhooks))
+	}
+	if cfg.PipelinesPath != "" {
+		pipelines, err := pipeline.Load(cfg.PipelinesPath)
+		if err != nil {
+			logger.Fatal("Invalid pipeline definitions", zap.Error(err))
+		}
+		if cfg.DefaultPipeline != "" {
+			if err := pipelines.SetDefault(cfg.DefaultPipeline); err != nil {
+				logger.Fatal("Invalid DEFAULT_PIPELINE", zap.Error(err))
+			}
+		}
+		logger.Info("Loaded pipelines",
+			zap.String("path", cfg.PipelinesPath),
+			zap.Strings("pipelines", pipelines.Names()),
+			zap.String("default", pipelines.Default()),
+		)
+		routerOpts = append(routerOpts, server.WithPipelines(pipelines))
+	}
+	router, handler := server.NewRouter(svc, logger, routerOpts...)
 	srv := server.NewServer(cfg.HTTPAddr, router, logger)
 
 	return &App{
-		Server: srv,
-		Logger: logger,
+		Server:   srv,
+		Logger:   logger,
+		handler:  handler,
+		prompts:  promptsDir,
+		store:    st,
+		webhooks: webhooks,
 	}
 }
 
@@ -42,5 +137,20 @@ func (a *App) Run() error {
 
 func (a *App) Shutdown(ctx context.Context) error {
 	a.Logger.Info("Shutting down server...")
+	if a.prompts != nil {
+		defer a.prompts.Close()
+	}
+	// Requests finishing during shutdown still record their outcome
+	defer a.store.Close()
+	// Deliveries still being retried are dead-lettered
+	if a.webhooks != nil {
+		defer a.webhooks.Close()
+	}
+	// Messages running detached from any connection, and the streams
+	// following them, only end once cancelled. They record their outcome
+	// and notify webhooks, so the store and webhooks close after them
+	if err := a.handler.Drain(ctx); err != nil {
+		a.Logger.Warn("Messages still running at shutdown", zap.Error(err))
+	}
 	return a.Server.Shutdown(ctx)
 }
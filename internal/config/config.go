@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -12,6 +13,34 @@ type Config struct {
 	HTTPAddr   string
 	LogLevel   string
 	Production bool
+
+	SchemaRepairAttempts int
+	CompletionPolicy     string
+
+	RequestTimeout     time.Duration
+	AgentTimeout       time.Duration
+	AgentTimeoutPolicy string
+	CombineTimeout     time.Duration
+
+	PipelinesPath   string
+	DefaultPipeline string
+
+	StreamAgents      bool
+	StreamGracePeriod time.Duration
+
+	JobsMax int
+	JobsTTL time.Duration
+
+	BatchConcurrency int
+
+	WebhookSecret         string
+	WebhookMaxAttempts    int
+	WebhookDeadLetterPath string
+
+	PromptsDir string
+
+	HistoryTurns int
+	StorePath    string
 }
 
 func Load() *Config {
@@ -24,6 +53,25 @@ func Load() *Config {
 	viper.SetDefault("PRODUCTION", false)
 	viper.SetDefault("HTTP_ADDR", ":8080")
 	viper.SetDefault("LOG_LEVEL", "info")
+	viper.SetDefault("SCHEMA_REPAIR_ATTEMPTS", 2)
+	viper.SetDefault("COMPLETION_POLICY", "all")
+	viper.SetDefault("REQUEST_TIMEOUT", "2m")
+	viper.SetDefault("AGENT_TIMEOUT", "0s")
+	viper.SetDefault("AGENT_TIMEOUT_POLICY", "skip")
+	viper.SetDefault("COMBINE_TIMEOUT", "0s")
+	viper.SetDefault("PIPELINES_PATH", "")
+	viper.SetDefault("DEFAULT_PIPELINE", "")
+	viper.SetDefault("STREAM_AGENTS", false)
+	viper.SetDefault("STREAM_GRACE_PERIOD", "30s")
+	viper.SetDefault("JOBS_MAX", 1000)
+	viper.SetDefault("JOBS_TTL", "1h")
+	viper.SetDefault("BATCH_CONCURRENCY", 4)
+	viper.SetDefault("WEBHOOK_SECRET", "")
+	viper.SetDefault("WEBHOOK_MAX_ATTEMPTS", 5)
+	viper.SetDefault("WEBHOOK_DEAD_LETTER_PATH", "")
+	viper.SetDefault("PROMPTS_DIR", "")
+	viper.SetDefault("HISTORY_TURNS", 10)
+	viper.SetDefault("STORE_PATH", "")
 
 	if err := viper.ReadInConfig(); err == nil {
 		log.Printf("Loaded .env config from: %s", viper.ConfigFileUsed())
@@ -37,5 +85,33 @@ func Load() *Config {
 		HTTPAddr:   viper.GetString("HTTP_ADDR"),
 		LogLevel:   viper.GetString("LOG_LEVEL"),
 		Production: viper.GetBool("PRODUCTION"),
+
+		SchemaRepairAttempts: viper.GetInt("SCHEMA_REPAIR_ATTEMPTS"),
+		CompletionPolicy:     viper.GetString("COMPLETION_POLICY"),
+
+		RequestTimeout:     viper.GetDuration("REQUEST_TIMEOUT"),
+		AgentTimeout:       viper.GetDuration("AGENT_TIMEOUT"),
+		AgentTimeoutPolicy: viper.GetString("AGENT_TIMEOUT_POLICY"),
+		CombineTimeout:     viper.GetDuration("COMBINE_TIMEOUT"),
+
+		PipelinesPath:   viper.GetString("PIPELINES_PATH"),
+		DefaultPipeline: viper.GetString("DEFAULT_PIPELINE"),
+
+		StreamAgents:      viper.GetBool("STREAM_AGENTS"),
+		StreamGracePeriod: viper.GetDuration("STREAM_GRACE_PERIOD"),
+
+		JobsMax: viper.GetInt("JOBS_MAX"),
+		JobsTTL: viper.GetDuration("JOBS_TTL"),
+
+		BatchConcurrency: viper.GetInt("BATCH_CONCURRENCY"),
+
+		WebhookSecret:         viper.GetString("WEBHOOK_SECRET"),
+		WebhookMaxAttempts:    viper.GetInt("WEBHOOK_MAX_ATTEMPTS"),
+		WebhookDeadLetterPath: viper.GetString("WEBHOOK_DEAD_LETTER_PATH"),
+
+		PromptsDir: viper.GetString("PROMPTS_DIR"),
+
+		HistoryTurns: viper.GetInt("HISTORY_TURNS"),
+		StorePath:    viper.GetString("STORE_PATH"),
 	}
 }
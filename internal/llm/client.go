@@ -2,6 +2,7 @@ package llm
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -11,8 +12,11 @@ type Client struct {
 	apiKey     string
 	model      string
 	baseURL    string
+	provider   string
 	httpClient *http.Client
 	logger     *zap.Logger
+	// noStreamUsage is set once the provider has rejected stream_options
+	noStreamUsage atomic.Bool
 }
 
 func NewClient(apiKey, model, baseURL string, logger *zap.Logger) *Client {
@@ -20,6 +24,7 @@ func NewClient(apiKey, model, baseURL string, logger *zap.Logger) *Client {
 		apiKey:     apiKey,
 		model:      model,
 		baseURL:    baseURL,
+		provider:   providerName(baseURL),
 		httpClient: &http.Client{Timeout: 15 * time.Second},
 		logger:     logger,
 	}
@@ -0,0 +1,39 @@
+package llm_test
+
+import (
+	"fmt"
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/llm/llmtest"
+
+	"go.uber.org/zap"
+)
+
+func TestClientConformance(t *testing.T) {
+	llmtest.RunConformance(t, func(t *testing.T, sc llmtest.Scenario) llm.Interface {
+		srv := llmtest.NewServer(t, sc)
+		return llm.NewClient("test-key", "test-model", srv.URL, zap.NewNop())
+	})
+}
+
+func TestMockClientConformance(t *testing.T) {
+	llmtest.RunConformance(t, func(t *testing.T, sc llmtest.Scenario) llm.Interface {
+		m := &llm.MockClient{
+			Chunks:     sc.Chunks,
+			ChunkDelay: sc.ChunkDelay,
+			Reasoning:  sc.Reasoning,
+			Usage:      sc.Usage,
+		}
+		switch {
+		case sc.EmptyChoices:
+			m.Chunks = []string{}
+		case sc.Status != 0:
+			m.Err = fmt.Errorf("mock error [%d]", sc.Status)
+		case sc.FailAfter > 0:
+			m.Err = fmt.Errorf("mock stream interrupted")
+			m.FailAfter = sc.FailAfter
+		}
+		return m
+	})
+}
@@ -5,15 +5,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 )
 
 type streamLine struct {
+	// Error is set when the provider fails after the stream has started
+	Error   json.RawMessage `json:"error"`
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
+			// Reasoning deltas: DeepSeek and most gateways use
+			// reasoning_content, OpenRouter uses reasoning
+			ReasoningContent string `json:"reasoning_content"`
+			Reasoning        string `json:"reasoning"`
 		} `json:"delta"`
 	} `json:"choices"`
+	// Usage arrives on the last chunk when stream_options.include_usage is set
+	Usage *Usage `json:"usage"`
 }
 
 type StreamingDecoder struct {
@@ -24,11 +33,13 @@ func NewStreamingDecoder(r io.Reader) *StreamingDecoder {
 	return &StreamingDecoder{reader: bufio.NewReader(r)}
 }
 
-func (d *StreamingDecoder) NextChunk() (string, error) {
+// NextChunk returns the next non-empty chunk, skipping keep-alives and deltas
+// with nothing in them. It returns io.EOF once the stream is done.
+func (d *StreamingDecoder) NextChunk() (Chunk, error) {
 	for {
 		line, err := d.reader.ReadString('\n')
 		if err != nil {
-			return "", err
+			return Chunk{}, err
 		}
 
 		line = strings.TrimSpace(line)
@@ -38,17 +49,44 @@ func (d *StreamingDecoder) NextChunk() (string, error) {
 
 		raw := strings.TrimPrefix(line, "data: ")
 		if raw == "[DONE]" {
-			return "", io.EOF
+			return Chunk{}, io.EOF
 		}
 
 		var parsed streamLine
 		if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
-			return "", fmt.Errorf("unmarshal stream chunk: %w", err)
+			return Chunk{}, fmt.Errorf("unmarshal stream chunk: %w", err)
 		}
-		if len(parsed.Choices) == 0 {
+		if len(parsed.Error) > 0 && string(parsed.Error) != "null" {
+			return Chunk{}, streamError(raw)
+		}
+
+		chunk := Chunk{Usage: parsed.Usage}
+		if len(parsed.Choices) > 0 {
+			delta := parsed.Choices[0].Delta
+			chunk.Content = delta.Content
+			chunk.Reasoning = firstNonEmpty(delta.ReasoningContent, delta.Reasoning)
+		}
+		if chunk.Content == "" && chunk.Reasoning == "" && chunk.Usage == nil {
 			continue
 		}
 
-		return parsed.Choices[0].Delta.Content, nil
+		return chunk, nil
+	}
+}
+
+func streamError(raw string) *ProviderError {
+	message, code := decodeErrorBody([]byte(raw))
+	if message == "" {
+		message = "stream interrupted by provider"
+	}
+	class, _ := classify(http.StatusOK, code, message)
+	if class == ErrorClassUnknown {
+		class = ErrorClassServer
+	}
+	return &ProviderError{
+		StatusCode: http.StatusOK,
+		Code:       code,
+		Class:      class,
+		Message:    sanitizeMessage(message),
 	}
 }
@@ -0,0 +1,269 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorClass is a coarse, client-safe category for a failed LLM call.
+type ErrorClass string
+
+const (
+	ErrorClassRateLimit      ErrorClass = "rate_limit"
+	ErrorClassQuota          ErrorClass = "quota_exceeded"
+	ErrorClassAuth           ErrorClass = "auth"
+	ErrorClassContextLength  ErrorClass = "context_length"
+	ErrorClassInvalidRequest ErrorClass = "invalid_request"
+	ErrorClassServer         ErrorClass = "server"
+	ErrorClassTimeout        ErrorClass = "timeout"
+	ErrorClassCancelled      ErrorClass = "cancelled"
+	ErrorClassUnknown        ErrorClass = "unknown"
+)
+
+// ProviderError is a failed response from an LLM provider, normalized across
+// the error formats of the OpenAI-compatible APIs we talk to.
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	// Code is the provider's own error code or type, e.g. "rate_limit_exceeded"
+	Code       string
+	Class      ErrorClass
+	Retryable  bool
+	RetryAfter time.Duration
+	// Message is the provider message with secrets redacted and length capped,
+	// safe to show to clients.
+	Message string
+}
+
+func (e *ProviderError) Error() string {
+	status := strconv.Itoa(e.StatusCode)
+	if e.Code != "" {
+		status += " " + e.Code
+	}
+	return fmt.Sprintf("%s error [%s]: %s", e.Provider, status, e.Message)
+}
+
+// ClassifyError maps any error returned by this package to an ErrorClass.
+func ClassifyError(err error) ErrorClass {
+	var perr *ProviderError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &perr):
+		return perr.Class
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCancelled
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+// ErrorMessage describes err in terms safe to show to clients: a provider's
+// redacted message, or a generic one for its class. Other errors may carry
+// URLs and transport details, so their text is never used.
+func ErrorMessage(err error) string {
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		return perr.Message
+	}
+	switch ClassifyError(err) {
+	case ErrorClassTimeout:
+		return "the request timed out"
+	case ErrorClassCancelled:
+		return "the request was cancelled"
+	default:
+		return "processing failed"
+	}
+}
+
+// providerErrorBody covers the shapes providers use for error payloads:
+//
+//	OpenAI, Azure, Groq, vLLM: {"error": {"message", "type", "code", "param"}}
+//	Anthropic:                 {"type": "error", "error": {"type", "message"}}
+//	Gemini:                    [{"error": {"code": 400, "message", "status"}}]
+//	Ollama and others:         {"error": "message"} or {"message"} or {"detail"}
+type providerErrorBody struct {
+	Error   json.RawMessage `json:"error"`
+	Message string          `json:"message"`
+	Detail  string          `json:"detail"`
+}
+
+type providerErrorDetail struct {
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+	Status  string          `json:"status"`
+}
+
+const maxErrorBody = 64 << 10
+
+// parseProviderError builds a ProviderError from a non-200 response.
+func parseProviderError(provider string, resp *http.Response) *ProviderError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	perr := &ProviderError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+
+	var message string
+	message, perr.Code = decodeErrorBody(body)
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	perr.Message = sanitizeMessage(message)
+	perr.Class, perr.Retryable = classify(resp.StatusCode, perr.Code, message)
+
+	return perr
+}
+
+func decodeErrorBody(body []byte) (message, code string) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		var list []json.RawMessage
+		if err := json.Unmarshal(body, &list); err == nil && len(list) > 0 {
+			body = list[0]
+		}
+	}
+
+	var parsed providerErrorBody
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		// Not JSON, e.g. an HTML page from a proxy; don't echo it back
+		return "", ""
+	}
+
+	if len(parsed.Error) > 0 {
+		var detail providerErrorDetail
+		if err := json.Unmarshal(parsed.Error, &detail); err == nil {
+			return detail.Message, firstNonEmpty(rawCode(detail.Code), detail.Type, detail.Status)
+		}
+		var text string
+		if err := json.Unmarshal(parsed.Error, &text); err == nil {
+			return text, ""
+		}
+	}
+	return firstNonEmpty(parsed.Message, parsed.Detail), ""
+}
+
+func rawCode(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	// Numeric codes only repeat the HTTP status
+	return ""
+}
+
+func classify(status int, code, message string) (ErrorClass, bool) {
+	lowerCode := strings.ToLower(code)
+	lowerMsg := strings.ToLower(message)
+
+	switch {
+	case strings.Contains(lowerCode, "context_length") ||
+		strings.Contains(lowerMsg, "maximum context length") ||
+		strings.Contains(lowerMsg, "context window") ||
+		strings.Contains(lowerMsg, "prompt is too long"):
+		return ErrorClassContextLength, false
+	case strings.Contains(lowerCode, "insufficient_quota") || strings.Contains(lowerCode, "billing"):
+		return ErrorClassQuota, false
+	case status == http.StatusTooManyRequests:
+		return ErrorClassRateLimit, true
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorClassAuth, false
+	case status == http.StatusRequestTimeout:
+		return ErrorClassTimeout, true
+	case status >= 500:
+		// Includes Anthropic's 529 overloaded
+		return ErrorClassServer, true
+	case status >= 400:
+		return ErrorClassInvalidRequest, false
+	default:
+		return ErrorClassUnknown, false
+	}
+}
+
+func parseRetryAfter(h http.Header) time.Duration {
+	if ms := h.Get("Retry-After-Ms"); ms != "" {
+		if n, err := strconv.ParseFloat(ms, 64); err == nil && n > 0 {
+			return time.Duration(n * float64(time.Millisecond))
+		}
+	}
+
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+const maxErrorMessage = 300
+
+var secretPattern = regexp.MustCompile(`(?i)(sk-[a-z0-9_\-]{6,}|bearer\s+[a-z0-9._\-]+|api[_-]?key=[^\s&]+)`)
+
+func sanitizeMessage(message string) string {
+	message = secretPattern.ReplaceAllString(message, "[redacted]")
+	message = strings.Join(strings.Fields(message), " ")
+
+	runes := []rune(message)
+	if len(runes) > maxErrorMessage {
+		message = string(runes[:maxErrorMessage]) + "..."
+	}
+	return message
+}
+
+// providerName labels errors by the API host the client talks to.
+func providerName(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "llm"
+	}
+	host := u.Hostname()
+	switch {
+	case strings.HasSuffix(host, "openai.com"):
+		return "openai"
+	case strings.HasSuffix(host, "openai.azure.com"):
+		return "azure"
+	case strings.HasSuffix(host, "anthropic.com"):
+		return "anthropic"
+	case strings.HasSuffix(host, "googleapis.com"):
+		return "gemini"
+	case strings.HasSuffix(host, "groq.com"):
+		return "groq"
+	case strings.HasSuffix(host, "openrouter.ai"):
+		return "openrouter"
+	default:
+		return "llm"
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+package llm_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestProviderError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		header     http.Header
+		body       string
+		class      llm.ErrorClass
+		code       string
+		retryable  bool
+		retryAfter time.Duration
+		message    string
+	}{
+		{
+			name:   "openai rate limit",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"20"}},
+			body:   `{"error":{"message":"Rate limit reached for gpt-4o","type":"requests","code":"rate_limit_exceeded"}}`,
+			class:  llm.ErrorClassRateLimit, code: "rate_limit_exceeded", retryable: true,
+			retryAfter: 20 * time.Second,
+			message:    "Rate limit reached for gpt-4o",
+		},
+		{
+			name:   "openai quota",
+			status: http.StatusTooManyRequests,
+			body:   `{"error":{"message":"You exceeded your current quota","type":"insufficient_quota","code":"insufficient_quota"}}`,
+			class:  llm.ErrorClassQuota, code: "insufficient_quota",
+			message: "You exceeded your current quota",
+		},
+		{
+			name:   "openai auth redacts key",
+			status: http.StatusUnauthorized,
+			body:   `{"error":{"message":"Incorrect API key provided: sk-abc123456789. You can find your API key at https://platform.openai.com.","type":"invalid_request_error","code":"invalid_api_key"}}`,
+			class:  llm.ErrorClassAuth, code: "invalid_api_key",
+			message: "Incorrect API key provided: [redacted]. You can find your API key at https://platform.openai.com.",
+		},
+		{
+			name:   "context length",
+			status: http.StatusBadRequest,
+			body:   `{"error":{"message":"This model's maximum context length is 128000 tokens.","type":"invalid_request_error","param":"messages","code":"context_length_exceeded"}}`,
+			class:  llm.ErrorClassContextLength, code: "context_length_exceeded",
+			message: "This model's maximum context length is 128000 tokens.",
+		},
+		{
+			name:   "anthropic overloaded",
+			status: 529,
+			body:   `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			class:  llm.ErrorClassServer, code: "overloaded_error", retryable: true,
+			message: "Overloaded",
+		},
+		{
+			name:   "gemini invalid argument",
+			status: http.StatusBadRequest,
+			body:   `[{"error":{"code":400,"message":"Invalid JSON payload","status":"INVALID_ARGUMENT"}}]`,
+			class:  llm.ErrorClassInvalidRequest, code: "INVALID_ARGUMENT",
+			message: "Invalid JSON payload",
+		},
+		{
+			name:   "html from proxy",
+			status: http.StatusBadGateway,
+			body:   `<html><body>upstream exploded</body></html>`,
+			class:  llm.ErrorClassServer, retryable: true,
+			message: "Bad Gateway",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			client := llm.NewClient("key", "model", srv.URL, zap.NewNop())
+			_, err := client.Call(context.Background(), nil)
+
+			var perr *llm.ProviderError
+			require.True(t, errors.As(err, &perr), "got %v", err)
+			require.Equal(t, tt.status, perr.StatusCode)
+			require.Equal(t, tt.class, perr.Class)
+			require.Equal(t, tt.code, perr.Code)
+			require.Equal(t, tt.retryable, perr.Retryable)
+			require.Equal(t, tt.retryAfter, perr.RetryAfter)
+			require.Equal(t, tt.message, perr.Message)
+			require.Equal(t, tt.class, llm.ClassifyError(err))
+		})
+	}
+}
+
+func TestStreamErrorMidStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n"))
+		w.Write([]byte("data: {\"error\":{\"message\":\"The server had an error\",\"type\":\"server_error\"}}\n\n"))
+	}))
+	defer srv.Close()
+
+	client := llm.NewClient("key", "model", srv.URL, zap.NewNop())
+
+	var content string
+	var streamErr error
+	for chunk, err := range client.Stream(context.Background(), nil) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		content += chunk.Content
+	}
+
+	require.Equal(t, "partial", content)
+	require.Equal(t, llm.ErrorClassServer, llm.ClassifyError(streamErr))
+	require.Contains(t, streamErr.Error(), "The server had an error")
+}
+
+func TestErrorMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"message": "Slow down", "type": "rate_limit_exceeded"}}`))
+	}))
+	defer srv.Close()
+	_, err := llm.NewClient("key", "model", srv.URL, zap.NewNop()).Call(context.Background(), nil)
+	require.Equal(t, "Slow down", llm.ErrorMessage(err))
+
+	// Transport errors name the upstream host, which clients mustn't see
+	srv.Close()
+	_, err = llm.NewClient("key", "model", srv.URL, zap.NewNop()).Call(context.Background(), nil)
+	require.Error(t, err)
+	require.NotContains(t, llm.ErrorMessage(err), "127.0.0.1")
+	require.Equal(t, "processing failed", llm.ErrorMessage(err))
+
+	require.Equal(t, "the request timed out", llm.ErrorMessage(context.DeadlineExceeded))
+}
@@ -2,21 +2,48 @@ package llm
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
 )
 
 type Interface interface {
-	Call(ctx context.Context, messages []ChatMessage) (string, error)
-	Stream(ctx context.Context, messages []ChatMessage) <-chan StreamResult
+	Call(ctx context.Context, messages []ChatMessage, opts ...Option) (Completion, error)
+	// Stream returns a pull-based iterator over the completion. The request is
+	// sent when iteration starts and its body is released as soon as the loop
+	// ends, including when the consumer breaks out early.
+	Stream(ctx context.Context, messages []ChatMessage, opts ...Option) iter.Seq2[Chunk, error]
 }
 
-type StreamResult struct {
+// Completion is a finished, non-streamed response.
+type Completion struct {
 	Content string
-	Err     error
+	// Reasoning is the model's thinking output, kept apart from the answer
+	Reasoning string
+	Usage     *Usage
+}
+
+// Chunk is a single delta of a streamed completion. A chunk carries answer
+// content, reasoning content, or the final usage report.
+type Chunk struct {
+	Content   string
+	Reasoning string
+	Usage     *Usage
+}
+
+type StreamResult struct {
+	Content   string
+	Reasoning string
+	Usage     *Usage
+	Err       error
 }
 
 type ChatMessage struct {
@@ -25,122 +52,178 @@ type ChatMessage struct {
 }
 
 type ChatCompletionRequest struct {
-	Model    string        `json:"model"`
-	Messages []ChatMessage `json:"messages"`
-	Stream   bool          `json:"stream,omitempty"`
+	Model          string          `json:"model"`
+	Messages       []ChatMessage   `json:"messages"`
+	Stream         bool            `json:"stream,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat selects plain text, free-form JSON ("json_object") or
+// schema-constrained JSON ("json_schema") output.
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict,omitempty"`
 }
 
 type ChatCompletionResponse struct {
 	Choices []struct {
-		Message ChatMessage `json:"message"`
+		Message struct {
+			ChatMessage
+			ReasoningContent string `json:"reasoning_content"`
+			Reasoning        string `json:"reasoning"`
+		} `json:"message"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage"`
 }
 
 // Call sends a prompt to the LLM and returns the result
-func (c *Client) Call(ctx context.Context, messages []ChatMessage) (string, error) {
-	reqBody := ChatCompletionRequest{
-		Model:    c.model,
-		Messages: messages,
-	}
-
-	bodyBytes, err := json.Marshal(reqBody)
+func (c *Client) Call(ctx context.Context, messages []ChatMessage, opts ...Option) (Completion, error) {
+	resp, err := c.send(ctx, c.newRequest(messages, false, opts))
 	if err != nil {
-		return "", fmt.Errorf("marshal request: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/chat/completions", bytes.NewReader(bodyBytes))
-	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("http request: %w", err)
+		return Completion{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("llm error [%d]: %s", resp.StatusCode, b)
+		return Completion{}, parseProviderError(c.provider, resp)
 	}
 
 	var parsed ChatCompletionResponse
 	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
-		return "", fmt.Errorf("decode response: %w", err)
+		return Completion{}, fmt.Errorf("decode response: %w", err)
 	}
 
 	if len(parsed.Choices) == 0 {
-		return "", fmt.Errorf("empty LLM response")
+		return Completion{}, fmt.Errorf("empty LLM response")
 	}
 
-	return parsed.Choices[0].Message.Content, nil
+	msg := parsed.Choices[0].Message
+	return Completion{
+		Content:   msg.Content,
+		Reasoning: firstNonEmpty(msg.ReasoningContent, msg.Reasoning),
+		Usage:     parsed.Usage,
+	}, nil
 }
 
-func (c *Client) Stream(ctx context.Context, messages []ChatMessage) <-chan StreamResult {
-	resultChan := make(chan StreamResult)
-
-	go func() {
-		defer close(resultChan)
-
-		reqBody := ChatCompletionRequest{
-			Model:    c.model,
-			Messages: messages,
-			Stream:   true,
-		}
-
-		bodyBytes, err := json.Marshal(reqBody)
+func (c *Client) Stream(ctx context.Context, messages []ChatMessage, opts ...Option) iter.Seq2[Chunk, error] {
+	return func(yield func(Chunk, error) bool) {
+		req := c.newRequest(messages, true, opts)
+		resp, err := c.send(ctx, req)
 		if err != nil {
-			resultChan <- StreamResult{Err: fmt.Errorf("marshal request: %w", err)}
+			yield(Chunk{}, err)
 			return
 		}
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/chat/completions", bytes.NewReader(bodyBytes))
-		if err != nil {
-			resultChan <- StreamResult{Err: fmt.Errorf("create request: %w", err)}
-			return
-		}
-
-		req.Header.Set("Authorization", "Bearer "+c.apiKey)
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := c.httpClient.Do(req)
-		if err != nil {
-			resultChan <- StreamResult{Err: fmt.Errorf("http request: %w", err)}
-			return
+		if resp.StatusCode == http.StatusBadRequest && req.StreamOptions != nil {
+			// Some gateways reject stream_options; try once without it, and
+			// leave it out from then on if that works. Other bad requests
+			// would only fail again
+			perr := parseProviderError(c.provider, resp)
+			resp.Body.Close()
+			if perr.Class != ErrorClassInvalidRequest || !rejectsStreamOptions(perr.Message) {
+				yield(Chunk{}, perr)
+				return
+			}
+			req.StreamOptions = nil
+			if resp, err = c.send(ctx, req); err != nil {
+				yield(Chunk{}, err)
+				return
+			}
+			if resp.StatusCode == http.StatusOK {
+				c.logger.Warn("Provider rejected stream_options, streaming without usage", zap.String("error", perr.Message))
+				c.noStreamUsage.Store(true)
+			}
 		}
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			b, _ := io.ReadAll(resp.Body)
-			resultChan <- StreamResult{Err: fmt.Errorf("llm stream error [%d]: %s", resp.StatusCode, b)}
+			yield(Chunk{}, parseProviderError(c.provider, resp))
 			return
 		}
 
 		// Read line by line from the stream
 		decoder := NewStreamingDecoder(resp.Body)
 		for {
-			select {
-			case <-ctx.Done():
-				resultChan <- StreamResult{Err: ctx.Err()}
+			if err := ctx.Err(); err != nil {
+				yield(Chunk{}, err)
 				return
-			default:
-				content, err := decoder.NextChunk()
-				if err == io.EOF {
-					return
-				}
-				if err != nil {
-					resultChan <- StreamResult{Err: err}
-					return
+			}
+
+			chunk, err := decoder.NextChunk()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				// A cancelled request surfaces as a read error on the body
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					err = ctxErr
 				}
-				if content != "" {
-					resultChan <- StreamResult{Content: content}
+				var perr *ProviderError
+				if errors.As(err, &perr) {
+					perr.Provider = c.provider
 				}
+				yield(Chunk{}, err)
+				return
+			}
+			if !yield(chunk, nil) {
+				return
 			}
 		}
-	}()
+	}
+}
+
+// rejectsStreamOptions reports whether an error message is about
+// stream_options.
+func rejectsStreamOptions(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "stream_options") || strings.Contains(message, "include_usage")
+}
 
-	return resultChan
+func (c *Client) newRequest(messages []ChatMessage, stream bool, opts []Option) ChatCompletionRequest {
+	o := applyOptions(opts)
+	req := ChatCompletionRequest{
+		Model:          cmp.Or(o.Model, c.model),
+		Messages:       messages,
+		Stream:         stream,
+		Temperature:    o.Temperature,
+		MaxTokens:      o.MaxTokens,
+		ResponseFormat: o.ResponseFormat,
+	}
+	if stream && !c.noStreamUsage.Load() {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	return req
+}
+
+func (c *Client) send(ctx context.Context, reqBody ChatCompletionRequest) (*http.Response, error) {
+	bodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/v1/chat/completions", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request: %w", err)
+	}
+	return resp, nil
 }
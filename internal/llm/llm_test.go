@@ -0,0 +1,117 @@
+package llm_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/llm/llmtest"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestClientStream_BreakReleasesBody(t *testing.T) {
+	released := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"tok%d \"}}]}\n\n", i)
+		}
+		w.(http.Flusher).Flush()
+
+		// Never finish the stream; only the client closing the body ends it
+		<-r.Context().Done()
+		close(released)
+	}))
+	defer srv.Close()
+
+	client := llm.NewClient("key", "model", srv.URL, zap.NewNop())
+
+	var got []string
+	for chunk, err := range client.Stream(context.Background(), nil) {
+		require.NoError(t, err)
+		got = append(got, chunk.Content)
+		break
+	}
+	require.Equal(t, []string{"tok0 "}, got)
+
+	select {
+	case <-released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("response body was not released after breaking out of the stream")
+	}
+}
+
+func TestStreamChan_StopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	results := llm.StreamChan(ctx, llm.NewMockClient().Stream(ctx, nil))
+	first := <-results
+	require.NoError(t, first.Err)
+	require.NotEmpty(t, first.Content)
+
+	// Abandon the channel; the producer must still exit and close it
+	cancel()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("channel adapter did not close after cancellation")
+		}
+	}
+}
+
+func TestClientStream_WithoutStreamOptions(t *testing.T) {
+	var requests []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req.StreamOptions != nil)
+		if req.StreamOptions != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"message": "Unrecognized request argument supplied: stream_options"}}`))
+			return
+		}
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"))
+	}))
+	defer srv.Close()
+
+	client := llm.NewClient("key", "model", srv.URL, zap.NewNop())
+	for range 2 {
+		var content string
+		for chunk, err := range client.Stream(context.Background(), nil) {
+			require.NoError(t, err)
+			content += chunk.Content
+		}
+		require.Equal(t, "hi", content)
+	}
+	// Once rejected, stream_options isn't sent again
+	require.Equal(t, []bool{true, false, false}, requests)
+}
+
+func TestClientStream_OtherBadRequest(t *testing.T) {
+	srv := llmtest.NewServer(t, llmtest.Scenario{
+		Status:    http.StatusBadRequest,
+		ErrorBody: `{"error": {"message": "messages must not be empty", "type": "invalid_request_error"}}`,
+	})
+	client := llm.NewClient("key", "model", srv.URL, zap.NewNop())
+
+	for _, err := range client.Stream(context.Background(), nil) {
+		require.ErrorContains(t, err, "messages must not be empty")
+	}
+	// Only a rejected stream_options is worth another try
+	requests := srv.Requests()
+	require.Len(t, requests, 1)
+	require.NotNil(t, requests[0].StreamOptions)
+}
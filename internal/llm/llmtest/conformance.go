@@ -0,0 +1,284 @@
+package llmtest
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"strings"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+)
+
+// Factory returns the implementation under test configured to behave as sc
+// describes, typically by pointing a client at NewServer(t, sc).
+type Factory func(t *testing.T, sc Scenario) llm.Interface
+
+// hangTimeout bounds every operation in the suite; exceeding it means the
+// implementation ignored cancellation or never closed its stream.
+const hangTimeout = 3 * time.Second
+
+var tokens = []string{"The ", "quick ", "brown ", "fox"}
+
+// RunConformance checks the behaviour shared by every llm.Interface
+// implementation: chunk ordering, cancellation and deadlines, empty responses
+// and error termination of both the iterator and the channel adapter.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("CallReturnsContent", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens})
+
+		got, err := client.Call(context.Background(), prompt())
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+		if want := strings.Join(tokens, ""); got.Content != want {
+			t.Fatalf("Call = %q, want %q", got.Content, want)
+		}
+	})
+
+	t.Run("StreamYieldsChunksInOrder", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens})
+
+		res := drain(t, client.Stream(context.Background(), prompt()))
+		if len(res.errs) > 0 {
+			t.Fatalf("unexpected errors: %v", res.errs)
+		}
+		if got, want := strings.Join(res.chunks, ""), strings.Join(tokens, ""); got != want {
+			t.Fatalf("stream = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("ReasoningKeptSeparate", func(t *testing.T) {
+		usage := &llm.Usage{PromptTokens: 10, CompletionTokens: 30, TotalTokens: 40, ReasoningTokens: 20}
+		client := factory(t, Scenario{Chunks: tokens, Reasoning: []string{"Let me ", "think."}, Usage: usage})
+
+		got, err := client.Call(context.Background(), prompt())
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+		if got.Content != strings.Join(tokens, "") || got.Reasoning != "Let me think." {
+			t.Fatalf("Call = %+v, want reasoning apart from content", got)
+		}
+		if got.Usage == nil || *got.Usage != *usage {
+			t.Fatalf("Call usage = %+v, want %+v", got.Usage, usage)
+		}
+
+		res := drain(t, client.Stream(context.Background(), prompt()))
+		if len(res.errs) > 0 {
+			t.Fatalf("unexpected errors: %v", res.errs)
+		}
+		if strings.Join(res.chunks, "") != strings.Join(tokens, "") || strings.Join(res.reasoning, "") != "Let me think." {
+			t.Fatalf("stream content %q, reasoning %q", res.chunks, res.reasoning)
+		}
+		if res.usage == nil || *res.usage != *usage {
+			t.Fatalf("stream usage = %+v, want %+v", res.usage, usage)
+		}
+	})
+
+	t.Run("StreamBreakStopsProducer", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: repeat("tok ", 100), ChunkDelay: 10 * time.Millisecond})
+
+		within(t, "breaking out of the stream", func() {
+			for _, err := range client.Stream(context.Background(), prompt()) {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				break
+			}
+		})
+	})
+
+	t.Run("CancelMidStream", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: repeat("tok ", 100), ChunkDelay: 10 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		seq := client.Stream(ctx, prompt())
+		res := drainWith(t, seq, func(received int) {
+			if received == 2 {
+				cancel()
+			}
+		})
+
+		if len(res.chunks) >= 100 {
+			t.Fatalf("stream ignored cancellation and delivered all %d chunks", len(res.chunks))
+		}
+		for _, err := range res.errs {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("error after cancel = %v, want context.Canceled", err)
+			}
+		}
+	})
+
+	t.Run("CallRespectsDeadline", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, ChunkDelay: time.Second})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		var err error
+		within(t, "Call past its deadline", func() {
+			_, err = client.Call(ctx, prompt())
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Call error = %v, want context.DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("StreamRespectsDeadline", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, ChunkDelay: time.Second})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		res := drain(t, client.Stream(ctx, prompt()))
+		if len(res.errs) != 1 || !errors.Is(res.errs[0], context.DeadlineExceeded) {
+			t.Fatalf("stream errors = %v, want a single context.DeadlineExceeded", res.errs)
+		}
+	})
+
+	t.Run("EmptyChoices", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, EmptyChoices: true})
+
+		if _, err := client.Call(context.Background(), prompt()); err == nil {
+			t.Fatal("Call with no choices returned no error")
+		}
+
+		res := drain(t, client.Stream(context.Background(), prompt()))
+		if len(res.chunks) > 0 {
+			t.Fatalf("stream with no choices yielded content %q", res.chunks)
+		}
+	})
+
+	t.Run("ErrorUpFront", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, Status: 503})
+
+		if _, err := client.Call(context.Background(), prompt()); err == nil {
+			t.Fatal("Call returned no error")
+		}
+
+		res := drain(t, client.Stream(context.Background(), prompt()))
+		if len(res.chunks) > 0 || len(res.errs) != 1 {
+			t.Fatalf("stream = %q, errors %v; want no chunks and one error", res.chunks, res.errs)
+		}
+	})
+
+	t.Run("ErrorMidStreamEndsStream", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, FailAfter: 2})
+
+		res := drain(t, client.Stream(context.Background(), prompt()))
+		if len(res.errs) != 1 {
+			t.Fatalf("got errors %v, want exactly one", res.errs)
+		}
+		if got := strings.Join(res.chunks, ""); got != strings.Join(tokens[:2], "") {
+			t.Fatalf("chunks before error = %q", got)
+		}
+	})
+
+	t.Run("ChannelClosesAfterError", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: tokens, FailAfter: 2})
+		ctx := context.Background()
+
+		var chunks, errs int
+		within(t, "draining the channel adapter", func() {
+			for res := range llm.StreamChan(ctx, client.Stream(ctx, prompt())) {
+				if errs > 0 {
+					t.Errorf("result after error: %+v", res)
+				}
+				if res.Err != nil {
+					errs++
+				} else {
+					chunks++
+				}
+			}
+		})
+		if chunks != 2 || errs != 1 {
+			t.Fatalf("got %d chunks and %d errors, want 2 and 1", chunks, errs)
+		}
+	})
+
+	t.Run("ChannelReleasedOnCancel", func(t *testing.T) {
+		client := factory(t, Scenario{Chunks: repeat("tok ", 100), ChunkDelay: 10 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+
+		results := llm.StreamChan(ctx, client.Stream(ctx, prompt()))
+		<-results
+		cancel()
+
+		within(t, "closing the abandoned channel", func() {
+			for range results {
+			}
+		})
+	})
+}
+
+type streamResult struct {
+	chunks    []string
+	reasoning []string
+	usage     *llm.Usage
+	errs      []error
+}
+
+func drain(t *testing.T, seq iter.Seq2[llm.Chunk, error]) streamResult {
+	return drainWith(t, seq, func(int) {})
+}
+
+// drainWith consumes the whole stream without breaking, so implementations
+// that keep yielding after an error are caught.
+func drainWith(t *testing.T, seq iter.Seq2[llm.Chunk, error], onChunk func(received int)) streamResult {
+	t.Helper()
+
+	var res streamResult
+	within(t, "draining the stream", func() {
+		for chunk, err := range seq {
+			if len(res.errs) > 0 {
+				t.Errorf("stream yielded after error %v: chunk=%q err=%v", res.errs[0], chunk.Content, err)
+			}
+			if err != nil {
+				res.errs = append(res.errs, err)
+				continue
+			}
+			if chunk.Reasoning != "" {
+				res.reasoning = append(res.reasoning, chunk.Reasoning)
+			}
+			if chunk.Usage != nil {
+				res.usage = chunk.Usage
+			}
+			if chunk.Content != "" {
+				res.chunks = append(res.chunks, chunk.Content)
+				onChunk(len(res.chunks))
+			}
+		}
+	})
+	return res
+}
+
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(hangTimeout):
+		t.Fatalf("%s did not finish within %s", what, hangTimeout)
+	}
+}
+
+func prompt() []llm.ChatMessage {
+	return []llm.ChatMessage{
+		{Role: "system", Content: "You are a conformance test"},
+		{Role: "user", Content: "Say something"},
+	}
+}
+
+func repeat(s string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = s
+	}
+	return out
+}
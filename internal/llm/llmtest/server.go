@@ -0,0 +1,207 @@
+// Package llmtest provides a fake OpenAI-compatible server and a conformance
+// suite every llm.Interface implementation is expected to pass.
+package llmtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+)
+
+// Scenario describes how a fake provider should answer.
+type Scenario struct {
+	// Chunks are the streamed deltas. Non-streaming calls get them joined.
+	Chunks []string
+	// Reasoning deltas are streamed as reasoning_content before Chunks.
+	Reasoning []string
+	// Usage is sent on the final chunk when the client asks for it, and on
+	// every non-streaming response.
+	Usage *llm.Usage
+	// ChunkDelay is waited before each chunk; non-streaming calls wait for
+	// the sum before answering.
+	ChunkDelay time.Duration
+	// Status, when non-zero, fails the request up front with this HTTP status
+	// and ErrorBody, or an OpenAI-style error if ErrorBody is empty.
+	Status    int
+	ErrorBody string
+	// FailAfter, when positive, makes streams send a provider error event
+	// after that many chunks and non-streaming calls fail with a 500.
+	FailAfter int
+	// EmptyChoices answers with no choices at all.
+	EmptyChoices bool
+}
+
+// Server is a fake OpenAI-compatible chat completions endpoint.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	scenario Scenario
+	requests []llm.ChatCompletionRequest
+}
+
+// NewServer starts a fake provider that is closed when the test ends.
+func NewServer(t testing.TB, sc Scenario) *Server {
+	s := &Server{scenario: sc}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetScenario changes the behaviour for subsequent requests.
+func (s *Server) SetScenario(sc Scenario) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scenario = sc
+}
+
+// Requests returns the decoded bodies of every request received so far.
+func (s *Server) Requests() []llm.ChatCompletionRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]llm.ChatCompletionRequest(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req llm.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	sc := s.scenario
+	s.mu.Unlock()
+
+	if sc.Status != 0 {
+		writeError(w, sc.Status, sc.ErrorBody, http.StatusText(sc.Status))
+		return
+	}
+
+	if req.Stream {
+		s.stream(w, r.Context(), sc, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+		return
+	}
+
+	if err := wait(r.Context(), sc.ChunkDelay*time.Duration(len(sc.Chunks))); err != nil {
+		return
+	}
+	if sc.FailAfter > 0 {
+		writeError(w, http.StatusInternalServerError, "", "The server had an error while processing your request.")
+		return
+	}
+
+	resp := map[string]any{"choices": []any{}}
+	if !sc.EmptyChoices {
+		message := map[string]any{"role": "assistant", "content": strings.Join(sc.Chunks, "")}
+		if len(sc.Reasoning) > 0 {
+			message["reasoning_content"] = strings.Join(sc.Reasoning, "")
+		}
+		resp["choices"] = []any{map[string]any{"message": message}}
+	}
+	if sc.Usage != nil {
+		resp["usage"] = wireUsage(sc.Usage)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) stream(w http.ResponseWriter, ctx context.Context, sc Scenario, includeUsage bool) {
+	flusher := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, reasoning := range sc.Reasoning {
+		if err := wait(ctx, sc.ChunkDelay); err != nil {
+			return
+		}
+		writeData(w, map[string]any{"choices": []any{map[string]any{"delta": map[string]any{"reasoning_content": reasoning}}}})
+		flusher.Flush()
+	}
+
+	for i, content := range sc.Chunks {
+		if sc.FailAfter > 0 && i == sc.FailAfter {
+			fmt.Fprint(w, "data: {\"error\":{\"message\":\"The server had an error while processing your request.\",\"type\":\"server_error\"}}\n\n")
+			flusher.Flush()
+			return
+		}
+		if err := wait(ctx, sc.ChunkDelay); err != nil {
+			return
+		}
+
+		delta := map[string]any{"choices": []any{map[string]any{"delta": map[string]any{"content": content}}}}
+		if sc.EmptyChoices {
+			delta = map[string]any{"choices": []any{}}
+		}
+		writeData(w, delta)
+		flusher.Flush()
+	}
+
+	if includeUsage && sc.Usage != nil {
+		writeData(w, map[string]any{"choices": []any{}, "usage": wireUsage(sc.Usage)})
+	}
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+func writeData(w http.ResponseWriter, v any) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(w, "data: %s\n\n", b)
+}
+
+// wireUsage renders usage the way OpenAI does, with reasoning tokens nested
+// under completion_tokens_details.
+func wireUsage(u *llm.Usage) map[string]any {
+	return map[string]any{
+		"prompt_tokens":     u.PromptTokens,
+		"completion_tokens": u.CompletionTokens,
+		"total_tokens":      u.TotalTokens,
+		"completion_tokens_details": map[string]any{
+			"reasoning_tokens": u.ReasoningTokens,
+		},
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, body, message string) {
+	if body == "" {
+		b, _ := json.Marshal(map[string]any{"error": map[string]any{
+			"message": message,
+			"type":    "fake_error",
+		}})
+		body = string(b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -2,20 +2,46 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"iter"
 	"strings"
 	"time"
 )
 
-type MockClient struct{}
+// MockClient answers with canned replies keyed by the system prompt. Setting
+// Chunks switches it to a scripted mode used by tests.
+type MockClient struct {
+	// Chunks, when non-nil, is the scripted reply: Call returns the chunks
+	// joined and Stream yields them one by one. An empty, non-nil slice
+	// behaves like a response without choices.
+	Chunks     []string
+	ChunkDelay time.Duration
+	// Reasoning is streamed ahead of Chunks as thinking output
+	Reasoning []string
+	Usage     *Usage
+	// Err fails scripted calls. Streams fail after FailAfter chunks.
+	Err       error
+	FailAfter int
+}
 
 func NewMockClient() *MockClient {
 	return &MockClient{}
 }
 
-func (m *MockClient) Call(ctx context.Context, messages []ChatMessage) (string, error) {
+func (m *MockClient) Call(ctx context.Context, messages []ChatMessage, opts ...Option) (Completion, error) {
+	if m.Chunks != nil {
+		return m.scriptedCall(ctx)
+	}
+
 	// Simulate latency
-	time.Sleep(1 * time.Second)
+	if err := sleep(ctx, 1*time.Second); err != nil {
+		return Completion{}, err
+	}
+
+	if o := applyOptions(opts); o.ResponseFormat != nil && o.ResponseFormat.Type != "text" {
+		return Completion{Content: mockJSON(o.ResponseFormat)}, nil
+	}
 
 	// Simulate different logic based on system prompt
 	system := ""
@@ -28,39 +54,128 @@ func (m *MockClient) Call(ctx context.Context, messages []ChatMessage) (string,
 
 	switch {
 	case system == "You are LLM 1":
-		time.Sleep(3 * time.Second)
-		return fmt.Sprintf("LLM1 processed: %s", messages[len(messages)-1].Content), nil
+		if err := sleep(ctx, 3*time.Second); err != nil {
+			return Completion{}, err
+		}
+		return Completion{Content: fmt.Sprintf("LLM1 processed: %s", messages[len(messages)-1].Content)}, nil
 	case system == "You are LLM 2":
-		time.Sleep(3 * time.Second)
-		return fmt.Sprintf("LLM2 processed: %s", messages[len(messages)-1].Content), nil
+		if err := sleep(ctx, 3*time.Second); err != nil {
+			return Completion{}, err
+		}
+		return Completion{Content: fmt.Sprintf("LLM2 processed: %s", messages[len(messages)-1].Content)}, nil
 	case system == "You are LLM 3. Combine and summarize the following responses:":
-		return "Combined summary of LLM1 and LLM2", nil
+		return Completion{Content: "Combined summary of LLM1 and LLM2"}, nil
 	default:
-		return "Mock LLM response", nil
+		return Completion{Content: "Mock LLM response"}, nil
 	}
 }
 
-func (m *MockClient) Stream(ctx context.Context, messages []ChatMessage) <-chan StreamResult {
-	resultChan := make(chan StreamResult)
-
-	go func() {
-		defer close(resultChan)
+func (m *MockClient) Stream(ctx context.Context, messages []ChatMessage, opts ...Option) iter.Seq2[Chunk, error] {
+	if m.Chunks != nil {
+		return m.scriptedStream(ctx)
+	}
 
+	return func(yield func(Chunk, error) bool) {
 		// Simulate a streaming response by splitting into "tokens"
 		response := "Combined summary of LLM1 and LLM2"
 		tokens := strings.Split(response, " ")
 
 		for _, token := range tokens {
+			if err := ctx.Err(); err != nil {
+				yield(Chunk{}, err)
+				return
+			}
+			if !yield(Chunk{Content: token + " "}, nil) {
+				return
+			}
+
 			select {
 			case <-ctx.Done():
-				resultChan <- StreamResult{Err: ctx.Err()}
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func (m *MockClient) scriptedCall(ctx context.Context) (Completion, error) {
+	if err := sleep(ctx, m.ChunkDelay*time.Duration(len(m.Chunks))); err != nil {
+		return Completion{}, err
+	}
+	if m.Err != nil {
+		return Completion{}, m.Err
+	}
+	if len(m.Chunks) == 0 {
+		return Completion{}, fmt.Errorf("empty LLM response")
+	}
+	return Completion{
+		Content:   strings.Join(m.Chunks, ""),
+		Reasoning: strings.Join(m.Reasoning, ""),
+		Usage:     m.Usage,
+	}, nil
+}
+
+func (m *MockClient) scriptedStream(ctx context.Context) iter.Seq2[Chunk, error] {
+	return func(yield func(Chunk, error) bool) {
+		for _, reasoning := range m.Reasoning {
+			if err := sleep(ctx, m.ChunkDelay); err != nil {
+				yield(Chunk{}, err)
+				return
+			}
+			if !yield(Chunk{Reasoning: reasoning}, nil) {
 				return
-			default:
-				resultChan <- StreamResult{Content: token + " "}
-				time.Sleep(200 * time.Millisecond)
 			}
 		}
-	}()
 
-	return resultChan
+		for i, content := range m.Chunks {
+			if m.Err != nil && i == m.FailAfter {
+				break
+			}
+			if err := sleep(ctx, m.ChunkDelay); err != nil {
+				yield(Chunk{}, err)
+				return
+			}
+			if !yield(Chunk{Content: content}, nil) {
+				return
+			}
+		}
+		if m.Err != nil {
+			yield(Chunk{}, m.Err)
+			return
+		}
+		if m.Usage != nil {
+			yield(Chunk{Usage: m.Usage}, nil)
+		}
+	}
+}
+
+// mockJSON answers a structured request with the smallest value its schema
+// accepts, so callers that decode the reply keep working in mock mode.
+func mockJSON(format *ResponseFormat) string {
+	if format.JSONSchema == nil {
+		return "{}"
+	}
+	schema, err := ParseSchema(format.JSONSchema.Name, format.JSONSchema.Schema)
+	if err != nil {
+		return "{}"
+	}
+	b, err := json.Marshal(schema.root.example())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
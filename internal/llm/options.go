@@ -0,0 +1,47 @@
+package llm
+
+// CallOptions are per-call overrides applied on top of the client defaults.
+type CallOptions struct {
+	ResponseFormat *ResponseFormat
+	Model          string
+	Temperature    *float64
+	MaxTokens      int
+}
+
+type Option func(*CallOptions)
+
+// WithResponseFormat asks the provider to constrain the output format.
+func WithResponseFormat(format *ResponseFormat) Option {
+	return func(o *CallOptions) {
+		o.ResponseFormat = format
+	}
+}
+
+// WithModel overrides the client's model for one call.
+func WithModel(model string) Option {
+	return func(o *CallOptions) {
+		o.Model = model
+	}
+}
+
+// WithTemperature sets the sampling temperature.
+func WithTemperature(t float64) Option {
+	return func(o *CallOptions) {
+		o.Temperature = &t
+	}
+}
+
+// WithMaxTokens caps the length of the completion.
+func WithMaxTokens(n int) Option {
+	return func(o *CallOptions) {
+		o.MaxTokens = n
+	}
+}
+
+func applyOptions(opts []Option) CallOptions {
+	var o CallOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
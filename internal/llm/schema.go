@@ -0,0 +1,312 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Schema is a JSON Schema used both to constrain the provider output and to
+// validate the decoded result locally. It supports the subset of keywords
+// providers accept for structured output: type, properties, required,
+// additionalProperties, items, enum and the numeric, length and size bounds.
+type Schema struct {
+	Name string
+	raw  json.RawMessage
+	root *schemaNode
+}
+
+type schemaNode struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*schemaNode `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"-"`
+	Items                *schemaNode            `json:"items"`
+	Enum                 []any                  `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+}
+
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+func (n *schemaNode) UnmarshalJSON(b []byte) error {
+	type plain schemaNode
+	var aux struct {
+		plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	*n = schemaNode(aux.plain)
+
+	// Only the boolean form is enforced; a schema here means "allowed"
+	if len(aux.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(aux.AdditionalProperties, &allowed); err == nil {
+			n.AdditionalProperties = &allowed
+		}
+	}
+	return nil
+}
+
+// ParseSchema compiles a JSON Schema document. The name is sent to providers
+// that require one for schema-constrained output.
+func ParseSchema(name string, raw []byte) (*Schema, error) {
+	var root schemaNode
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("parse schema %q: %w", name, err)
+	}
+	return &Schema{Name: name, raw: json.RawMessage(raw), root: &root}, nil
+}
+
+// MustSchema is like ParseSchema but panics on error. Intended for schemas
+// declared as Go literals.
+func MustSchema(name, raw string) *Schema {
+	s, err := ParseSchema(name, []byte(raw))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ResponseFormat returns the request format that asks the provider to follow
+// the schema.
+func (s *Schema) ResponseFormat() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &JSONSchemaFormat{
+			Name:   s.Name,
+			Schema: s.raw,
+		},
+	}
+}
+
+// Decode parses a model response and validates it against the schema.
+// Markdown code fences around the JSON are tolerated.
+func (s *Schema) Decode(text string) (any, error) {
+	var v any
+	if err := json.Unmarshal([]byte(stripCodeFence(text)), &v); err != nil {
+		return nil, fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if err := s.Validate(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ValidationError lists every place a value violates the schema.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "schema validation failed: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks a value decoded with encoding/json into an empty interface.
+func (s *Schema) Validate(v any) error {
+	var problems []string
+	s.root.validate("$", v, &problems)
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (n *schemaNode) validate(path string, v any, problems *[]string) {
+	fail := func(format string, args ...any) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(n.Type) > 0 && !n.Type.matches(v) {
+		fail("expected %s, got %s", strings.Join(n.Type, " or "), jsonType(v))
+		return
+	}
+
+	if len(n.Enum) > 0 {
+		found := false
+		for _, allowed := range n.Enum {
+			if reflect.DeepEqual(allowed, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed enum values")
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		for _, name := range n.Required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := n.Properties[k]
+			if !ok {
+				if n.AdditionalProperties != nil && !*n.AdditionalProperties {
+					fail("unexpected property %q", k)
+				}
+				continue
+			}
+			prop.validate(path+"."+k, val[k], problems)
+		}
+
+	case []any:
+		if n.MinItems != nil && len(val) < *n.MinItems {
+			fail("expected at least %d items, got %d", *n.MinItems, len(val))
+		}
+		if n.MaxItems != nil && len(val) > *n.MaxItems {
+			fail("expected at most %d items, got %d", *n.MaxItems, len(val))
+		}
+		if n.Items != nil {
+			for i, item := range val {
+				n.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, problems)
+			}
+		}
+
+	case string:
+		length := len([]rune(val))
+		if n.MinLength != nil && length < *n.MinLength {
+			fail("expected at least %d characters, got %d", *n.MinLength, length)
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			fail("expected at most %d characters, got %d", *n.MaxLength, length)
+		}
+
+	case float64:
+		if n.Minimum != nil && val < *n.Minimum {
+			fail("must be >= %v", *n.Minimum)
+		}
+		if n.Maximum != nil && val > *n.Maximum {
+			fail("must be <= %v", *n.Maximum)
+		}
+	}
+}
+
+func (t schemaTypes) matches(v any) bool {
+	for _, want := range t {
+		got := jsonType(v)
+		if want == got || (want == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	text = strings.TrimPrefix(text, "```")
+	if nl := strings.IndexByte(text, '\n'); nl >= 0 {
+		// Drop the language tag, e.g. ```json
+		text = text[nl+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "```"))
+}
+
+// example builds a small value that satisfies the node, for clients that
+// fake structured output.
+func (n *schemaNode) example() any {
+	if len(n.Enum) > 0 {
+		return n.Enum[0]
+	}
+	typ := ""
+	if len(n.Type) > 0 {
+		typ = n.Type[0]
+	}
+	switch typ {
+	case "object":
+		v := make(map[string]any, len(n.Required))
+		for _, name := range n.Required {
+			var prop any
+			if node, ok := n.Properties[name]; ok {
+				prop = node.example()
+			}
+			v[name] = prop
+		}
+		return v
+	case "array":
+		v := []any{}
+		if n.MinItems != nil && n.Items != nil {
+			for range *n.MinItems {
+				v = append(v, n.Items.example())
+			}
+		}
+		return v
+	case "string":
+		v := "mock"
+		if n.MinLength != nil && *n.MinLength > len(v) {
+			v = strings.Repeat("x", *n.MinLength)
+		}
+		if n.MaxLength != nil && *n.MaxLength < len(v) {
+			v = v[:*n.MaxLength]
+		}
+		return v
+	case "number", "integer":
+		switch {
+		case n.Minimum != nil:
+			return math.Ceil(*n.Minimum)
+		case n.Maximum != nil && *n.Maximum < 0:
+			return math.Floor(*n.Maximum)
+		}
+		return 0.0
+	case "boolean":
+		return false
+	default:
+		return nil
+	}
+}
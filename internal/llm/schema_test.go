@@ -0,0 +1,132 @@
+package llm_test
+
+import (
+	"context"
+	"iter"
+	"testing"
+
+	"llmsse/internal/llm"
+
+	"github.com/stretchr/testify/require"
+)
+
+var claimsSchema = llm.MustSchema("claims", `{
+	"type": "object",
+	"required": ["claims"],
+	"additionalProperties": false,
+	"properties": {
+		"claims": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["text", "confidence"],
+				"properties": {
+					"text": {"type": "string", "minLength": 1},
+					"confidence": {"type": "number", "minimum": 0, "maximum": 1}
+				}
+			}
+		}
+	}
+}`)
+
+func TestSchemaDecode(t *testing.T) {
+	v, err := claimsSchema.Decode("```json\n{\"claims\":[{\"text\":\"sky is blue\",\"confidence\":0.9}]}\n```")
+	require.NoError(t, err)
+	require.Len(t, v.(map[string]any)["claims"], 1)
+
+	_, err = claimsSchema.Decode(`{"claims":[{"text":"","confidence":2}],"extra":true}`)
+	var verr *llm.ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.ElementsMatch(t, []string{
+		`$: unexpected property "extra"`,
+		"$.claims[0].confidence: must be <= 1",
+		"$.claims[0].text: expected at least 1 characters, got 0",
+	}, verr.Problems)
+}
+
+type scriptedLLM struct {
+	replies []string
+	seen    [][]llm.ChatMessage
+}
+
+func (s *scriptedLLM) Call(_ context.Context, messages []llm.ChatMessage, _ ...llm.Option) (llm.Completion, error) {
+	s.seen = append(s.seen, messages)
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	return llm.Completion{Content: reply, Usage: &llm.Usage{TotalTokens: 10}}, nil
+}
+
+func (s *scriptedLLM) Stream(context.Context, []llm.ChatMessage, ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	return func(func(llm.Chunk, error) bool) {}
+}
+
+func TestCallJSON_Repairs(t *testing.T) {
+	client := &scriptedLLM{replies: []string{
+		`{"claims": []}`,
+		`{"claims": [{"text": "water is wet", "confidence": 0.7}]}`,
+	}}
+
+	prompt := []llm.ChatMessage{{Role: "user", Content: "list claims"}}
+	value, res, err := llm.CallJSON(context.Background(), client, prompt, claimsSchema, 1)
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	require.Contains(t, res.Content, "water is wet")
+	require.Equal(t, 20, res.Usage.TotalTokens)
+
+	// The repair prompt carries the failed answer and the validation problem
+	require.Len(t, client.seen, 2)
+	require.Len(t, client.seen[1], 3)
+	require.Equal(t, "assistant", client.seen[1][1].Role)
+	require.Contains(t, client.seen[1][2].Content, "expected at least 1 items")
+}
+
+func TestCallJSON_GivesUp(t *testing.T) {
+	client := &scriptedLLM{replies: []string{"not json", "still not json"}}
+
+	_, _, err := llm.CallJSON(context.Background(), client, nil, claimsSchema, 1)
+	require.ErrorContains(t, err, "invalid after 2 attempts")
+}
+
+func TestCallJSON_NegativeRepairs(t *testing.T) {
+	client := &scriptedLLM{replies: []string{"not json"}}
+
+	_, _, err := llm.CallJSON(context.Background(), client, nil, claimsSchema, -1)
+	require.ErrorContains(t, err, "invalid after 1 attempts")
+	require.NotContains(t, err.Error(), "%!")
+}
+
+func TestCallJSON_KeepsCallerOptions(t *testing.T) {
+	client := &scriptedLLM{replies: []string{`{"claims": [{"text": "a", "confidence": 1}]}`}}
+	opts := make([]llm.Option, 1, 2)
+	opts[0] = llm.WithTemperature(0)
+
+	_, _, err := llm.CallJSON(context.Background(), client, nil, claimsSchema, 0, opts...)
+	require.NoError(t, err)
+	require.Nil(t, opts[:2][1])
+}
+
+func TestMockClient_SatisfiesSchema(t *testing.T) {
+	verdict := llm.MustSchema("verdict", `{
+		"type": "object",
+		"required": ["best", "reason"],
+		"additionalProperties": false,
+		"properties": {
+			"best": {"type": "string", "enum": ["llm-1", "llm-2"]},
+			"reason": {"type": "string"}
+		}
+	}`)
+
+	t.Run("claims", func(t *testing.T) {
+		t.Parallel()
+		value, _, err := llm.CallJSON(context.Background(), llm.NewMockClient(), nil, claimsSchema, 0)
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{"claims": []any{map[string]any{"text": "mock", "confidence": 0.0}}}, value)
+	})
+	t.Run("verdict", func(t *testing.T) {
+		t.Parallel()
+		value, _, err := llm.CallJSON(context.Background(), llm.NewMockClient(), nil, verdict, 0)
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{"best": "llm-1", "reason": "mock"}, value)
+	})
+}
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"context"
+	"iter"
+)
+
+// StreamChan adapts a pull-based stream to the channel form used before
+// Stream returned an iterator. The channel is closed after the first error or
+// once the stream ends. If the consumer stops reading it must cancel ctx, which
+// stops the producer and releases the underlying stream.
+func StreamChan(ctx context.Context, seq iter.Seq2[Chunk, error]) <-chan StreamResult {
+	resultChan := make(chan StreamResult)
+
+	go func() {
+		defer close(resultChan)
+
+		for chunk, err := range seq {
+			select {
+			case resultChan <- StreamResult{
+				Content:   chunk.Content,
+				Reasoning: chunk.Reasoning,
+				Usage:     chunk.Usage,
+				Err:       err,
+			}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return resultChan
+}
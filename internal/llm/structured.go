@@ -0,0 +1,52 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// CallJSON requests output matching schema and returns the decoded value along
+// with the completion holding the JSON text. When the response does not parse
+// or validate, the model is shown its answer and the problems and asked again,
+// up to repairs more times. Usage covers every attempt.
+func CallJSON(
+	ctx context.Context,
+	client Interface,
+	messages []ChatMessage,
+	schema *Schema,
+	repairs int,
+	opts ...Option,
+) (any, Completion, error) {
+	conversation := append([]ChatMessage(nil), messages...)
+	// The caller's opts may have spare capacity, so append to a copy
+	opts = append(slices.Clip(opts), WithResponseFormat(schema.ResponseFormat()))
+	repairs = max(repairs, 0)
+
+	var usage Usage
+	var lastErr error
+	for attempt := 0; attempt <= repairs; attempt++ {
+		res, err := client.Call(ctx, conversation, opts...)
+		if err != nil {
+			return nil, Completion{}, err
+		}
+		usage.Add(res.Usage)
+
+		value, err := schema.Decode(res.Content)
+		if err == nil {
+			res.Content = stripCodeFence(res.Content)
+			res.Usage = &usage
+			return value, res, nil
+		}
+		lastErr = err
+
+		conversation = append(conversation,
+			ChatMessage{Role: "assistant", Content: res.Content},
+			ChatMessage{Role: "user", Content: fmt.Sprintf(
+				"Your previous response did not match the required JSON schema: %v. "+
+					"Reply again with only a corrected JSON document.", err)},
+		)
+	}
+
+	return nil, Completion{}, fmt.Errorf("structured output %q invalid after %d attempts: %w", schema.Name, repairs+1, lastErr)
+}
@@ -0,0 +1,50 @@
+package llm
+
+import "encoding/json"
+
+// Usage is the token accounting reported by the provider. Reasoning tokens
+// are part of CompletionTokens but reported separately so they can be billed
+// and monitored on their own.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	ReasoningTokens  int `json:"reasoning_tokens,omitempty"`
+}
+
+func (u *Usage) UnmarshalJSON(b []byte) error {
+	var wire struct {
+		PromptTokens            int `json:"prompt_tokens"`
+		CompletionTokens        int `json:"completion_tokens"`
+		TotalTokens             int `json:"total_tokens"`
+		ReasoningTokens         int `json:"reasoning_tokens"`
+		CompletionTokensDetails struct {
+			ReasoningTokens int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+
+	*u = Usage{
+		PromptTokens:     wire.PromptTokens,
+		CompletionTokens: wire.CompletionTokens,
+		TotalTokens:      wire.TotalTokens,
+		ReasoningTokens:  wire.ReasoningTokens,
+	}
+	if d := wire.CompletionTokensDetails.ReasoningTokens; d > 0 {
+		u.ReasoningTokens = d
+	}
+	return nil
+}
+
+// Add accumulates other into u. A nil other is ignored.
+func (u *Usage) Add(other *Usage) {
+	if other == nil {
+		return
+	}
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.ReasoningTokens += other.ReasoningTokens
+}
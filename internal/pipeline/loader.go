@@ -0,0 +1,415 @@
+// Package pipeline loads named service pipelines from YAML definitions.
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"llmsse/internal/prompt"
+	"llmsse/internal/service"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error points at the line of a pipeline file a problem was found on.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+type fileSpec struct {
+	Default   string    `yaml:"default"`
+	Pipelines yaml.Node `yaml:"pipelines"`
+}
+
+type pipelineSpec struct {
+	Description string      `yaml:"description"`
+	MaxParallel int         `yaml:"max_parallel"`
+	Stages      []stageSpec `yaml:"stages"`
+}
+
+type stageSpec struct {
+	ID        string      `yaml:"id"`
+	DependsOn []string    `yaml:"depends_on"`
+	When      string      `yaml:"when"`
+	Policy    string      `yaml:"policy"`
+	Final     bool        `yaml:"final"`
+	Combine   string      `yaml:"combine"`
+	Debate    *debateSpec `yaml:"debate"`
+	Vote      *voteSpec   `yaml:"vote"`
+	Agents    []agentSpec `yaml:"agents"`
+
+	line int
+}
+
+type voteSpec struct {
+	Samples     int     `yaml:"samples"`
+	Temperature float64 `yaml:"temperature"`
+	Equivalence string  `yaml:"equivalence"`
+}
+
+type debateSpec struct {
+	Rounds   int     `yaml:"rounds"`
+	Converge float64 `yaml:"converge"`
+}
+
+type agentSpec struct {
+	ID     string `yaml:"id"`
+	System string `yaml:"system"`
+	Prompt string `yaml:"prompt"`
+	// SystemTemplate and PromptTemplate name templates of the prompt registry
+	// instead of spelling them out
+	SystemTemplate string        `yaml:"system_template"`
+	PromptTemplate string        `yaml:"prompt_template"`
+	Model          string        `yaml:"model"`
+	Temperature    *float64      `yaml:"temperature"`
+	MaxTokens      int           `yaml:"max_tokens"`
+	Timeout        time.Duration `yaml:"timeout"`
+	OnTimeout      string        `yaml:"on_timeout"`
+	Fallback       string        `yaml:"fallback"`
+
+	line int
+}
+
+func (s *stageSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain stageSpec
+	s.line = node.Line
+	return decodeStrict(node, (*plain)(s))
+}
+
+func (v *voteSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain voteSpec
+	return decodeStrict(node, (*plain)(v))
+}
+
+func (d *debateSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain debateSpec
+	return decodeStrict(node, (*plain)(d))
+}
+
+func (a *agentSpec) UnmarshalYAML(node *yaml.Node) error {
+	type plain agentSpec
+	a.line = node.Line
+	return decodeStrict(node, (*plain)(a))
+}
+
+// Registry holds the pipelines available to requests.
+type Registry struct {
+	pipelines   map[string]*service.Pipeline
+	defaultName string
+}
+
+// NewRegistry wraps pipelines built in Go, with def used when a request
+// doesn't name one.
+func NewRegistry(def string, pipelines ...*service.Pipeline) *Registry {
+	r := &Registry{pipelines: make(map[string]*service.Pipeline), defaultName: def}
+	for _, p := range pipelines {
+		r.pipelines[p.Name] = p
+	}
+	return r
+}
+
+// Get returns the named pipeline, or the default for an empty name.
+func (r *Registry) Get(name string) (*service.Pipeline, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+	p, ok := r.pipelines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pipeline %q, have %s", name, strings.Join(r.Names(), ", "))
+	}
+	return p, nil
+}
+
+// SetDefault changes the pipeline used when a request doesn't name one.
+func (r *Registry) SetDefault(name string) error {
+	if _, ok := r.pipelines[name]; !ok {
+		return fmt.Errorf("default pipeline %q is not defined", name)
+	}
+	r.defaultName = name
+	return nil
+}
+
+func (r *Registry) Default() string {
+	return r.defaultName
+}
+
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.pipelines))
+	for name := range r.pipelines {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Load reads and validates the pipeline file at path.
+func Load(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pipelines: %w", err)
+	}
+	return Parse(path, data)
+}
+
+// Parse builds a registry from YAML. file names the source in errors.
+func Parse(file string, data []byte) (*Registry, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &Error{File: file, Msg: err.Error()}
+	}
+	if len(root.Content) == 0 {
+		return nil, &Error{File: file, Msg: "no pipelines defined"}
+	}
+
+	var spec fileSpec
+	if err := decodeStrict(root.Content[0], &spec); err != nil {
+		return nil, wrapError(file, err)
+	}
+	if spec.Pipelines.Kind != yaml.MappingNode || len(spec.Pipelines.Content) == 0 {
+		return nil, &Error{File: file, Line: spec.Pipelines.Line, Msg: "pipelines must be a non-empty mapping of name to pipeline"}
+	}
+
+	r := &Registry{pipelines: make(map[string]*service.Pipeline), defaultName: spec.Default}
+	for i := 0; i < len(spec.Pipelines.Content); i += 2 {
+		key, value := spec.Pipelines.Content[i], spec.Pipelines.Content[i+1]
+		if _, ok := r.pipelines[key.Value]; ok {
+			return nil, &Error{File: file, Line: key.Line, Msg: fmt.Sprintf("duplicate pipeline %q", key.Value)}
+		}
+
+		var ps pipelineSpec
+		if err := decodeStrict(value, &ps); err != nil {
+			return nil, wrapError(file, err)
+		}
+		p, err := build(key.Value, ps)
+		if err != nil {
+			var perr *Error
+			if errors.As(err, &perr) {
+				perr.File = file
+				return nil, perr
+			}
+			return nil, &Error{File: file, Line: key.Line, Msg: err.Error()}
+		}
+		r.pipelines[key.Value] = p
+	}
+
+	if r.defaultName == "" {
+		if len(r.pipelines) != 1 {
+			return nil, &Error{File: file, Msg: "default is required when more than one pipeline is defined"}
+		}
+		r.defaultName = r.Names()[0]
+	}
+	if _, ok := r.pipelines[r.defaultName]; !ok {
+		return nil, &Error{File: file, Msg: fmt.Sprintf("default pipeline %q is not defined", r.defaultName)}
+	}
+	return r, nil
+}
+
+func build(name string, ps pipelineSpec) (*service.Pipeline, error) {
+	p := &service.Pipeline{Name: name, MaxParallel: ps.MaxParallel}
+	for _, ss := range ps.Stages {
+		st, err := buildStage(name, ss)
+		if err != nil {
+			line := ss.line
+			var perr *Error
+			if errors.As(err, &perr) {
+				line, err = perr.Line, errors.New(perr.Msg)
+			}
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("stage %q: %v", ss.ID, err)}
+		}
+		p.Stages = append(p.Stages, st)
+	}
+
+	// Point dependency errors at the stage that declares them
+	ids := make(map[string]bool, len(ps.Stages))
+	for _, ss := range ps.Stages {
+		ids[ss.ID] = true
+	}
+	for _, ss := range ps.Stages {
+		for _, dep := range ss.DependsOn {
+			if !ids[dep] {
+				return nil, &Error{Line: ss.line, Msg: fmt.Sprintf("stage %q depends on unknown stage %q", ss.ID, dep)}
+			}
+		}
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func buildStage(pipeline string, ss stageSpec) (service.Stage, error) {
+	st := service.Stage{
+		ID:        ss.ID,
+		DependsOn: ss.DependsOn,
+		Final:     ss.Final || ss.Combine != "",
+	}
+
+	if ss.When != "" {
+		when, err := prompt.New(pipeline+"/"+ss.ID+".when", "", ss.When)
+		if err != nil {
+			return service.Stage{}, err
+		}
+		st.When = service.WhenTemplate(when)
+	}
+
+	if d := ss.Debate; d != nil {
+		if d.Rounds < 1 {
+			return service.Stage{}, errors.New("debate needs at least one round")
+		}
+		if d.Converge < 0 || d.Converge > 1 {
+			return service.Stage{}, errors.New("debate converge must be between 0 and 1")
+		}
+		st.Debate = &service.Debate{Rounds: d.Rounds, Converge: d.Converge}
+	}
+
+	if v := ss.Vote; v != nil {
+		if v.Samples < 1 {
+			return service.Stage{}, errors.New("vote needs at least one sample")
+		}
+		equivalence, err := service.ParseEquivalence(v.Equivalence)
+		if err != nil {
+			return service.Stage{}, err
+		}
+		st.Vote = &service.Vote{Samples: v.Samples, Temperature: v.Temperature, Equivalence: equivalence}
+	}
+
+	if ss.Policy != "" {
+		policy, err := service.ParsePolicy(ss.Policy)
+		if err != nil {
+			return service.Stage{}, err
+		}
+		st.Policy = &policy
+	}
+
+	specs := make([]service.TaskTemplate, 0, len(ss.Agents))
+	for _, as := range ss.Agents {
+		spec, err := buildAgent(pipeline, as)
+		if err != nil {
+			return service.Stage{}, &Error{Line: as.line, Msg: fmt.Sprintf("agent %q: %v", as.ID, err)}
+		}
+		specs = append(specs, spec)
+	}
+
+	switch {
+	case ss.Combine == "" && len(specs) == 0:
+		return service.Stage{}, errors.New("needs at least one agent or a combine strategy")
+	case ss.Combine != "" && len(specs) == 0:
+		combiner, err := service.ParseCombiner(ss.Combine)
+		if err != nil {
+			return service.Stage{}, err
+		}
+		st.Combine = combiner
+		return st, nil
+	case ss.Combine == service.CombineSynthesis:
+		// A custom combine agent sees the inputs as its prompt by default
+		for i := range specs {
+			if specs[i].Prompt == nil && specs[i].PromptID == "" {
+				specs[i].Prompt = combineInputs
+			}
+		}
+	case ss.Combine != "":
+		return service.Stage{}, fmt.Errorf("combine strategy %q takes no agents; only %q can use a custom agent",
+			ss.Combine, service.CombineSynthesis)
+	}
+
+	st.Tasks = service.TemplateTasks(specs...)
+	return st, nil
+}
+
+var combineInputs = prompt.Must("combine.inputs", "v1", "{{.Inputs}}")
+
+func buildAgent(pipeline string, as agentSpec) (service.TaskTemplate, error) {
+	if as.ID == "" {
+		return service.TaskTemplate{}, errors.New("id is required")
+	}
+	var onTimeout service.TimeoutPolicy
+	if as.OnTimeout != "" {
+		p, err := service.ParseTimeoutPolicy(as.OnTimeout)
+		if err != nil {
+			return service.TaskTemplate{}, err
+		}
+		onTimeout = p
+	}
+
+	spec := service.TaskTemplate{
+		ID:          as.ID,
+		SystemID:    as.SystemTemplate,
+		PromptID:    as.PromptTemplate,
+		Model:       as.Model,
+		Temperature: as.Temperature,
+		MaxTokens:   as.MaxTokens,
+		Timeout:     as.Timeout,
+		OnTimeout:   onTimeout,
+		Fallback:    as.Fallback,
+	}
+	if as.System != "" {
+		if as.SystemTemplate != "" {
+			return service.TaskTemplate{}, errors.New("system and system_template are mutually exclusive")
+		}
+		t, err := prompt.New(pipeline+"/"+as.ID+".system", "", as.System)
+		if err != nil {
+			return service.TaskTemplate{}, err
+		}
+		spec.System = t
+	}
+	if as.Prompt != "" {
+		if as.PromptTemplate != "" {
+			return service.TaskTemplate{}, errors.New("prompt and prompt_template are mutually exclusive")
+		}
+		t, err := prompt.New(pipeline+"/"+as.ID+".prompt", "", as.Prompt)
+		if err != nil {
+			return service.TaskTemplate{}, err
+		}
+		spec.Prompt = t
+	}
+	return spec, nil
+}
+
+// decodeStrict decodes node into out, rejecting mapping keys out has no
+// field for so that typos don't silently drop settings.
+func decodeStrict(node *yaml.Node, out any) error {
+	if node.Kind == yaml.MappingNode {
+		known := yamlKeys(reflect.TypeOf(out).Elem())
+		for i := 0; i < len(node.Content); i += 2 {
+			key := node.Content[i]
+			if !known[key.Value] {
+				return &Error{Line: key.Line, Msg: fmt.Sprintf("unknown field %q", key.Value)}
+			}
+		}
+	}
+	return node.Decode(out)
+}
+
+func yamlKeys(t reflect.Type) map[string]bool {
+	keys := make(map[string]bool, t.NumField())
+	for i := range t.NumField() {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
+
+func wrapError(file string, err error) error {
+	var perr *Error
+	if errors.As(err, &perr) {
+		perr.File = file
+		return perr
+	}
+	return &Error{File: file, Msg: err.Error()}
+}
@@ -0,0 +1,121 @@
+package pipeline_test
+
+import (
+	"testing"
+
+	"llmsse/internal/pipeline"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_ShippedPipelines(t *testing.T) {
+	reg, err := pipeline.Load("../../configs/pipelines.yaml")
+	require.NoError(t, err)
+	require.Equal(t, []string{"consistent", "debate", "default", "experts"}, reg.Names())
+
+	p, err := reg.Get("")
+	require.NoError(t, err)
+	require.Equal(t, "default", p.Name)
+
+	_, err = reg.Get("missing")
+	require.ErrorContains(t, err, `unknown pipeline "missing"`)
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "unknown field",
+			yaml: `
+pipelines:
+  p:
+    stages:
+      - id: a
+        combine: synthesis
+        agnets: []
+`,
+			want: `p.yaml:7: unknown field "agnets"`,
+		},
+		{
+			name: "unknown dependency",
+			yaml: `
+pipelines:
+  p:
+    stages:
+      - id: a
+        agents: [{id: x}]
+      - id: b
+        depends_on: [c]
+        combine: synthesis
+`,
+			want: `p.yaml:7: stage "b" depends on unknown stage "c"`,
+		},
+		{
+			name: "bad template",
+			yaml: `
+pipelines:
+  p:
+    stages:
+      - id: a
+        agents:
+          - id: x
+            prompt: "{{.Message"
+      - id: b
+        depends_on: [a]
+        combine: synthesis
+`,
+			want: `p.yaml:7: stage "a": agent "x": parse template p/x.prompt`,
+		},
+		{
+			name: "bad policy",
+			yaml: `
+pipelines:
+  p:
+    stages:
+      - id: a
+        policy: most
+        combine: synthesis
+`,
+			want: `p.yaml:5: stage "a": unknown completion policy "most"`,
+		},
+		{
+			name: "cycle",
+			yaml: `
+pipelines:
+  p:
+    stages:
+      - id: a
+        depends_on: [b]
+        agents: [{id: x}]
+      - id: b
+        depends_on: [a]
+        agents: [{id: y}]
+      - id: c
+        depends_on: [a]
+        combine: synthesis
+`,
+			want: `p.yaml:3: pipeline "p": dependency cycle`,
+		},
+		{
+			name: "missing default",
+			yaml: `
+default: nope
+pipelines:
+  p:
+    stages:
+      - id: a
+        combine: synthesis
+`,
+			want: `default pipeline "nope" is not defined`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pipeline.Parse("p.yaml", []byte(tt.yaml))
+			require.ErrorContains(t, err, tt.want)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package prompt
+
+// IDs of the built-in templates. A template directory can override any of
+// them by defining the same ID.
+const (
+	AgentCreative    = "agent.creative"
+	AgentFactual     = "agent.factual"
+	CombineSynthesis = "combine.synthesis"
+	CombineJudge     = "combine.judge"
+	CombineRank      = "combine.rank"
+	CombineRanked    = "combine.ranked"
+	DebateRevise     = "debate.revise"
+	VoteEquivalence  = "vote.equivalence"
+)
+
+const localeInstruction = `{{if .Locale}} Write the answer for the {{.Locale}} locale, in its language.{{end}}`
+
+var builtin = []*Template{
+	Must(AgentCreative, "v1", `You are LLM 1. For each response:
+- Approach every question and problem with creativity and originality.
+- Explore novel ideas, unconventional solutions, and imaginative perspectives.
+- Don't limit yourself to standard or obvious answers—think broadly and innovatively.
+- When appropriate, use metaphors, analogies, or storytelling to illustrate your points and make your explanations engaging.
+- Present your ideas clearly and confidently, encouraging curiosity and inspiration in the user.`),
+
+	Must(AgentFactual, "v1", `You are LLM 2. For each response:
+- Ensure all information is accurate, verifiable, and based on reliable sources.
+- If a claim or fact cannot be verified, explicitly state the uncertainty or lack of evidence.
+- Do not provide answers solely based on internal confidence; support your conclusions with proof, reasoning, or referenced data when possible.
+- Reason through complex problems step by step, and quote or cite your sources where appropriate.
+- Present responses clearly, precisely, and with careful fact-checking.`),
+
+	Must(CombineSynthesis, "v1", `You are LLM 3. Combine and summarize the following responses. Each response is `+
+		`labeled with the agent that wrote it; attribute points to their source where it helps the reader.`+localeInstruction),
+
+	Must(CombineJudge, "v1", `You are a judge. Pick the single response that best answers the question: `+
+		`correct, complete and clear. Reply with the label of that response and a one-sentence reason.`),
+
+	Must(CombineRank, "v1", `You are a judge. Rank the responses from best to worst answer to the question. `+
+		`Reply with every label exactly once.`),
+
+	Must(CombineRanked, "v1", `You are LLM 3. Merge the following responses into one answer. They are ordered `+
+		`best first; where they conflict, prefer the higher-ranked response.`+localeInstruction),
+
+	Must(DebateRevise, "v1", `These are the latest answers from the other agents:
+
+{{.Inputs}}
+
+Use their reasoning as additional evidence. Point out anything you now think is wrong, in your answer or theirs, `+
+		`and give your revised answer to the original question.`),
+
+	Must(VoteEquivalence, "v1", `You compare answers. Group the numbered answers that state the same final `+
+		`answer, even if worded differently. Every number belongs to exactly one group.`),
+}
+
+// Builtin returns the templates the service ships with.
+func Builtin() *Registry {
+	r, err := NewRegistry(builtin...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
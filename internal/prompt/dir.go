@@ -0,0 +1,227 @@
+package prompt
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Source provides the registry to render a request with. Callers take one
+// snapshot per request so a reload never changes a prompt mid-request.
+type Source interface {
+	Current() *Registry
+}
+
+// Current returns r; a plain registry never changes.
+func (r *Registry) Current() *Registry {
+	return r
+}
+
+// Ext is the extension of template files in a prompt directory.
+const Ext = ".tmpl"
+
+// A template file may start with a version line; without one the version
+// is derived from the text.
+var versionLine = regexp.MustCompile(`^\{\{/\*\s*version:\s*(\S+)\s*\*/\}\}\r?\n?`)
+
+// reloadDelay batches the burst of events an editor or a config map update
+// produces into one reload.
+const reloadDelay = 100 * time.Millisecond
+
+// Dir is a registry of the templates in a directory, layered over a base
+// registry and reloaded when the files change. Each file <id>.tmpl defines
+// template id.
+type Dir struct {
+	path   string
+	base   *Registry
+	logger *zap.Logger
+
+	current atomic.Pointer[Registry]
+	// loaded holds the last good template of every file, by ID
+	loaded map[string]*Template
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// OpenDir loads the templates in path over base and watches the directory
+// for changes until Close. Unlike a reload, the initial load fails on any
+// template that doesn't parse.
+func OpenDir(path string, base *Registry, logger *zap.Logger) (*Dir, error) {
+	d := &Dir{path: path, base: base, logger: logger, done: make(chan struct{})}
+
+	loaded, failed, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		return nil, failed[slices.Min(slices.Collect(maps.Keys(failed)))]
+	}
+	d.loaded = loaded
+	d.publish()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("watch prompt directory: %w", err)
+	}
+	if err := watcher.Add(path); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watch prompt directory: %w", err)
+	}
+	d.watcher = watcher
+
+	d.wg.Add(1)
+	go d.watch()
+	return d, nil
+}
+
+func (d *Dir) Current() *Registry {
+	return d.current.Load()
+}
+
+func (d *Dir) Close() error {
+	close(d.done)
+	err := d.watcher.Close()
+	d.wg.Wait()
+	return err
+}
+
+func (d *Dir) watch() {
+	defer d.wg.Done()
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-d.done:
+			timer.Stop()
+			return
+		case ev, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			if strings.HasSuffix(ev.Name, Ext) || ev.Has(fsnotify.Create|fsnotify.Remove) {
+				timer.Reset(reloadDelay)
+			}
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			d.logger.Warn("Prompt directory watch error", zap.String("path", d.path), zap.Error(err))
+		case <-timer.C:
+			d.reload()
+		}
+	}
+}
+
+// reload rereads the directory and swaps in the result. A file that no
+// longer parses keeps its last good template.
+func (d *Dir) reload() {
+	loaded, failed, err := d.read()
+	if err != nil {
+		d.logger.Error("Failed to reload prompt directory", zap.String("path", d.path), zap.Error(err))
+		return
+	}
+	for id, err := range failed {
+		old, ok := d.loaded[id]
+		if !ok {
+			d.logger.Error("Ignoring invalid prompt template", zap.Error(err))
+			continue
+		}
+		d.logger.Error("Keeping last good prompt template", zap.String("template", old.Ref()), zap.Error(err))
+		loaded[id] = old
+	}
+
+	var changed bool
+	for id, t := range loaded {
+		old, ok := d.loaded[id]
+		switch {
+		case !ok:
+			d.logger.Info("Prompt template added", zap.String("template", t.Ref()))
+		case old.Version != t.Version:
+			d.logger.Info("Prompt template updated",
+				zap.String("template", t.Ref()),
+				zap.String("previous", old.Ref()),
+			)
+		case old.Source != t.Source:
+			d.logger.Warn("Prompt template changed without a new version", zap.String("template", t.Ref()))
+		default:
+			continue
+		}
+		changed = true
+	}
+	for id, old := range d.loaded {
+		if _, ok := loaded[id]; !ok {
+			d.logger.Info("Prompt template removed", zap.String("template", old.Ref()))
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	d.loaded = loaded
+	d.publish()
+}
+
+func (d *Dir) publish() {
+	templates := make([]*Template, 0, len(d.loaded))
+	for _, t := range d.loaded {
+		templates = append(templates, t)
+	}
+	d.current.Store(d.base.With(templates...))
+}
+
+// read parses every template file, returning the ones that parsed and the
+// errors of those that didn't, both by ID.
+func (d *Dir) read() (map[string]*Template, map[string]error, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read prompt directory: %w", err)
+	}
+
+	loaded := make(map[string]*Template)
+	failed := make(map[string]error)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), Ext) {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name(), Ext)
+		t, err := readTemplate(filepath.Join(d.path, e.Name()), id)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		loaded[id] = t
+	}
+	return loaded, failed, nil
+}
+
+func readTemplate(path, id string) (*Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := string(data)
+	var version string
+	if m := versionLine.FindStringSubmatch(text); m != nil {
+		version = m[1]
+		text = text[len(m[0]):]
+	}
+	t, err := New(id, version, text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
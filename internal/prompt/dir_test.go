@@ -0,0 +1,69 @@
+package prompt_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"llmsse/internal/prompt"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDir_Reload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644))
+	}
+	write("combine.synthesis.tmpl", "{{/* version: v7 */}}\nSummarize for {{.Locale}}.")
+
+	d, err := prompt.OpenDir(dir, prompt.Builtin(), zap.NewNop())
+	require.NoError(t, err)
+	defer d.Close()
+
+	started := d.Current()
+	synthesis, err := started.Get(prompt.CombineSynthesis)
+	require.NoError(t, err)
+	require.Equal(t, "combine.synthesis@v7", synthesis.Ref())
+	_, err = started.Get(prompt.AgentCreative)
+	require.NoError(t, err, "built-in templates stay available")
+
+	ref := func(id string) string {
+		t, err := d.Current().Get(id)
+		if err != nil {
+			return ""
+		}
+		return t.Ref()
+	}
+
+	write("combine.synthesis.tmpl", "{{/* version: v8 */}}\nSummarize.")
+	write("agent.extra.tmpl", "{{/* version: v1 */}}\nExtra.")
+	require.Eventually(t, func() bool {
+		return ref(prompt.CombineSynthesis) == "combine.synthesis@v8" && ref("agent.extra") == "agent.extra@v1"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A request that started earlier keeps the version it started with
+	synthesis, err = started.Get(prompt.CombineSynthesis)
+	require.NoError(t, err)
+	require.Equal(t, "combine.synthesis@v7", synthesis.Ref())
+
+	// A broken edit keeps the last good template, while others still reload
+	write("combine.synthesis.tmpl", "{{/* version: v9 */}}\n{{.Message")
+	write("agent.extra.tmpl", "{{/* version: v2 */}}\nExtra.")
+	require.Eventually(t, func() bool { return ref("agent.extra") == "agent.extra@v2" }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "combine.synthesis@v8", ref(prompt.CombineSynthesis))
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "agent.extra.tmpl")))
+	require.Eventually(t, func() bool { return ref("agent.extra") == "" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOpenDir_InvalidTemplate(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad.tmpl"), []byte("{{.Message"), 0o644))
+
+	_, err := prompt.OpenDir(dir, prompt.Builtin(), zap.NewNop())
+	require.ErrorContains(t, err, "parse template bad")
+}
@@ -0,0 +1,135 @@
+// Package prompt holds versioned text/template prompts and the registry they
+// are looked up in.
+package prompt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Turn is one exchange of an earlier conversation.
+type Turn struct {
+	User      string
+	Assistant string
+}
+
+// Data is what templates are rendered with.
+type Data struct {
+	Message string
+	History []Turn
+	Locale  string
+	// Outputs maps earlier stage IDs to their text, Results maps agent IDs to
+	// their answers and Inputs is the labeled output of the direct
+	// dependencies.
+	Outputs map[string]string
+	Results map[string]string
+	Inputs  string
+}
+
+// Template is a parsed prompt with an identity that is recorded on
+// everything it produces.
+type Template struct {
+	ID      string
+	Version string
+	Source  string
+
+	tmpl *template.Template
+}
+
+var funcs = template.FuncMap{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+}
+
+// New parses text as template id. An empty version is derived from the
+// text, so edits to an unversioned prompt still show up as a new version.
+func New(id, version, text string) (*Template, error) {
+	if id == "" {
+		return nil, fmt.Errorf("template has no id")
+	}
+	tmpl, err := template.New(id).Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template %s: %w", id, err)
+	}
+	if version == "" {
+		sum := sha256.Sum256([]byte(text))
+		version = "sha-" + hex.EncodeToString(sum[:4])
+	}
+	return &Template{ID: id, Version: version, Source: text, tmpl: tmpl}, nil
+}
+
+// Must is New for templates known to be valid.
+func Must(id, version, text string) *Template {
+	t, err := New(id, version, text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Ref identifies the template as id@version.
+func (t *Template) Ref() string {
+	return t.ID + "@" + t.Version
+}
+
+func (t *Template) Render(data Data) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render template %s: %w", t.Ref(), err)
+	}
+	return buf.String(), nil
+}
+
+// Registry maps template IDs to templates. It is immutable; With returns an
+// extended copy.
+type Registry struct {
+	templates map[string]*Template
+}
+
+func NewRegistry(templates ...*Template) (*Registry, error) {
+	r := &Registry{templates: make(map[string]*Template, len(templates))}
+	for _, t := range templates {
+		if _, ok := r.templates[t.ID]; ok {
+			return nil, fmt.Errorf("duplicate template %q", t.ID)
+		}
+		r.templates[t.ID] = t
+	}
+	return r, nil
+}
+
+// With returns a registry where templates replace any with the same ID.
+func (r *Registry) With(templates ...*Template) *Registry {
+	out := &Registry{templates: make(map[string]*Template, len(r.templates)+len(templates))}
+	for id, t := range r.templates {
+		out.templates[id] = t
+	}
+	for _, t := range templates {
+		out.templates[t.ID] = t
+	}
+	return out
+}
+
+func (r *Registry) Get(id string) (*Template, error) {
+	t, ok := r.templates[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt template %q", id)
+	}
+	return t, nil
+}
+
+func (r *Registry) IDs() []string {
+	ids := make([]string, 0, len(r.templates))
+	for id := range r.templates {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,52 @@
+package prompt_test
+
+import (
+	"testing"
+
+	"llmsse/internal/prompt"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	tmpl, err := prompt.New("greet", "", "{{.Message}} in {{.Locale}}{{range .History}} / {{.User}}{{end}}")
+	require.NoError(t, err)
+	require.Regexp(t, `^greet@sha-[0-9a-f]{8}$`, tmpl.Ref())
+
+	out, err := tmpl.Render(prompt.Data{
+		Message: "hi",
+		Locale:  "fr-FR",
+		History: []prompt.Turn{{User: "earlier"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "hi in fr-FR / earlier", out)
+
+	same := prompt.Must("greet", "", tmpl.Source)
+	require.Equal(t, tmpl.Version, same.Version)
+
+	missing := prompt.Must("missing", "v1", "{{.Results.nobody}}")
+	_, err = missing.Render(prompt.Data{Results: map[string]string{}})
+	require.ErrorContains(t, err, "render template missing@v1")
+}
+
+func TestRegistry(t *testing.T) {
+	reg := prompt.Builtin()
+	synthesis, err := reg.Get(prompt.CombineSynthesis)
+	require.NoError(t, err)
+	require.Equal(t, "combine.synthesis@v1", synthesis.Ref())
+
+	out, err := synthesis.Render(prompt.Data{Locale: "de-DE"})
+	require.NoError(t, err)
+	require.Contains(t, out, "de-DE")
+
+	override := reg.With(prompt.Must(prompt.CombineSynthesis, "v2", "Summarize."))
+	synthesis, err = override.Get(prompt.CombineSynthesis)
+	require.NoError(t, err)
+	require.Equal(t, "v2", synthesis.Version)
+
+	_, err = reg.Get("nope")
+	require.ErrorContains(t, err, `unknown prompt template "nope"`)
+
+	_, err = prompt.NewRegistry(prompt.Must("a", "v1", ""), prompt.Must("a", "v2", ""))
+	require.ErrorContains(t, err, `duplicate template "a"`)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"llmsse/internal/llm"
+
+	"go.uber.org/zap"
+)
+
+const (
+	maxBatchConcurrency = 32
+	maxBatchBytes       = 32 << 20
+	maxBatchLineBytes   = 1 << 20
+)
+
+// errInvalidItem marks an item rejected for its own content. Like the 400s
+// of /api/process, its message is returned as is.
+var errInvalidItem = errors.New("invalid request")
+
+// batchItem is one line of a batch: a request, or why it couldn't be read.
+type batchItem struct {
+	line int
+	req  processRequest
+	err  error
+}
+
+type batchResult struct {
+	// Line is the item's 1-based line number in the input
+	Line       int        `json:"line"`
+	MessageID  string     `json:"message_id,omitempty"`
+	Status     string     `json:"status"`
+	Answer     string     `json:"answer,omitempty"`
+	Template   string     `json:"template,omitempty"`
+	Usage      *llm.Usage `json:"usage,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ErrorClass string     `json:"error_class,omitempty"`
+	DurationMS int64      `json:"duration_ms"`
+}
+
+// ProcessBatch runs a JSONL body of process requests, up to the concurrency
+// query parameter at a time, and streams back a JSONL result per item as it
+// finishes. A failing item is reported and doesn't stop the others.
+func (h *Handler) ProcessBatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	concurrency, err := queryInt(r, "concurrency", h.batchConcurrency)
+	if err != nil || concurrency < 1 || concurrency > maxBatchConcurrency {
+		http.Error(w, "concurrency must be between 1 and "+strconv.Itoa(maxBatchConcurrency), http.StatusBadRequest)
+		return
+	}
+
+	// The body is read in full first; an HTTP/1 handler can't read its
+	// request once it has started to respond
+	items, err := readBatch(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	// A batch runs for as long as its items take
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Warn("clearing write deadline", zap.Error(err))
+	}
+
+	results := make(chan batchResult)
+	go func() {
+		defer close(results)
+		h.runBatch(r.Context(), items, concurrency, results)
+	}()
+
+	enc := json.NewEncoder(w)
+	var failed int
+	for res := range results {
+		if res.Status != jobCompleted {
+			failed++
+		}
+		if err := enc.Encode(res); err != nil {
+			h.logger.Error("encoding batch result", zap.Error(err))
+			continue
+		}
+		flusher.Flush()
+	}
+	h.logger.Info("Batch finished", zap.Int("items", len(items)), zap.Int("failed", failed))
+}
+
+// readBatch reads a JSONL batch, skipping blank lines. Lines that aren't
+// valid requests become items carrying the error.
+func readBatch(r io.Reader) ([]batchItem, error) {
+	id := "batch_" + strings.ToLower(rand.Text())
+
+	var items []batchItem
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxBatchLineBytes)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+
+		item := batchItem{line: line}
+		if err := json.Unmarshal([]byte(text), &item.req); err != nil {
+			item.err = fmt.Errorf("%w: %w", errInvalidItem, err)
+		} else if item.req.Message == "" {
+			item.err = fmt.Errorf("%w: message is empty", errInvalidItem)
+		}
+		if item.req.MessageID == "" {
+			item.req.MessageID = id + "-" + strconv.Itoa(line)
+		}
+		items = append(items, item)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read batch: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, errors.New("batch is empty")
+	}
+	return items, nil
+}
+
+func (h *Handler) runBatch(ctx context.Context, items []batchItem, concurrency int, results chan<- batchResult) {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, item := range items {
+		// Once ctx is done the running items end early, and the rest fail
+		// at once
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results <- h.runBatchItem(ctx, item)
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *Handler) runBatchItem(ctx context.Context, item batchItem) batchResult {
+	start := time.Now()
+	var o outcome
+	err := item.err
+	if err == nil {
+		err = h.runOutcome(ctx, item.req, &o)
+	}
+	if err != nil {
+		h.logger.Warn("Batch item failed", zap.Int("line", item.line), zap.String("message_id", item.req.MessageID), zap.Error(err))
+		o.fail(err)
+	}
+
+	return batchResult{
+		Line:       item.line,
+		MessageID:  item.req.MessageID,
+		Status:     o.status,
+		Answer:     o.answer.String(),
+		Template:   o.template,
+		Usage:      o.usage,
+		Error:      o.err,
+		ErrorClass: o.errorClass,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+}
+
+// runOutcome runs req to the end, collecting its events into o.
+func (h *Handler) runOutcome(ctx context.Context, req processRequest, o *outcome) error {
+	opts, err := h.processOptions(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidItem, err)
+	}
+	p, err := h.pipelines.Get(req.Pipeline)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidItem, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c, err := h.claim(ctx, ctx, req, true)
+	if err != nil {
+		return err
+	}
+	switch {
+	case c.stored != nil:
+		for _, ev := range storedEvents(*c.stored) {
+			o.record(ev)
+		}
+	case c.ctx == nil:
+		// Another request started the message; wait for its outcome
+		return follow(ctx, c.run, o.record)
+	default:
+		h.execute(c.ctx, c.cancel, c.run, req, p, opts, o.record)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBatch(t *testing.T) {
+	stub := &stubLLM{delay: 20 * time.Millisecond}
+	srv, _ := newServer(t, stub)
+
+	body := strings.Join([]string{
+		`{"message": "one", "message_id": "item-1"}`,
+		`{"message": "two"}`,
+		``,
+		`{"message": "please fail"}`,
+		`not json`,
+		`{"message": "five"}`,
+		`{"message": "six"}`,
+	}, "\n")
+	res, err := http.Post(srv.URL+"/api/batch?concurrency=2", "application/x-ndjson", strings.NewReader(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+	byLine := make(map[int]batchLine)
+	for sc := bufio.NewScanner(res.Body); sc.Scan(); {
+		var l batchLine
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &l))
+		byLine[l.Line] = l
+	}
+
+	// The failing items are reported and the others still run
+	require.Len(t, byLine, 6)
+	for _, n := range []int{1, 2, 6, 7} {
+		require.Equal(t, "completed", byLine[n].Status, "line %d", n)
+		require.Equal(t, "tok0 ", byLine[n].Answer)
+		require.NotNil(t, byLine[n].Usage)
+		require.Empty(t, byLine[n].Error)
+	}
+	require.Equal(t, "item-1", byLine[1].MessageID)
+	require.NotEmpty(t, byLine[2].MessageID)
+
+	// Failures are described as in error events, without the raw error
+	require.Equal(t, "failed", byLine[4].Status)
+	require.Equal(t, "processing failed", byLine[4].Error)
+	require.Equal(t, "unknown", byLine[4].ErrorClass)
+	// except for what was wrong with the item itself
+	require.Equal(t, "failed", byLine[5].Status)
+	require.Contains(t, byLine[5].Error, "invalid request")
+	require.Equal(t, "invalid_request", byLine[5].ErrorClass)
+
+	// Each item asks two agents at once
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	require.LessOrEqual(t, stub.peak, 2*2)
+	require.Greater(t, stub.peak, 2, "items ran one at a time")
+}
+
+func TestProcessBatch_Invalid(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{})
+
+	for _, tt := range []struct{ query, body string }{
+		{"?concurrency=0", `{"message": "q"}`},
+		{"?concurrency=33", `{"message": "q"}`},
+		{"", "\n\n"},
+	} {
+		res, err := http.Post(srv.URL+"/api/batch"+tt.query, "application/x-ndjson", strings.NewReader(tt.body))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "%q %q", tt.query, tt.body)
+	}
+}
@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"encoding/json"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+func del(t *testing.T, srv *httptest.Server, path string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+path, nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestCancelMessage(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{gate: make(chan struct{})})
+	stream := post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-1"})
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+	next, stop := iter.Pull(sseEvents(t, stream.Body))
+	defer stop()
+	_, ok := next()
+	require.True(t, ok)
+
+	res := del(t, srv, "/api/process/msg-1")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var cancelled service.StatusEvent
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&cancelled))
+	require.Equal(t, service.StatusCancelled, cancelled.Status)
+	require.True(t, cancelled.Final)
+
+	// The original stream ends with the same event
+	var rest []sseEvent
+	for e, ok := next(); ok; e, ok = next() {
+		rest = append(rest, e)
+	}
+	require.Equal(t, cancelled, last(rest))
+
+	require.Equal(t, http.StatusConflict, del(t, srv, "/api/process/msg-1").StatusCode, "already cancelled")
+	require.Equal(t, http.StatusNotFound, del(t, srv, "/api/process/msg-9").StatusCode)
+}
+
+func TestCancelMessage_Finished(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{})
+	all := readEvents(t, post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-1"}).Body)
+	require.Equal(t, service.StatusCompleted, last(all).Status)
+
+	require.Equal(t, http.StatusConflict, del(t, srv, "/api/process/msg-1").StatusCode)
+}
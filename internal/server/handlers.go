@@ -1,26 +1,128 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"llmsse/internal/llm"
+	"llmsse/internal/pipeline"
+	"llmsse/internal/prompt"
 	"llmsse/internal/service"
+	"llmsse/internal/store"
+	"llmsse/internal/webhook"
 
+	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 type Handler struct {
-	svc    *service.Service
-	logger *zap.Logger
+	svc            *service.Service
+	logger         *zap.Logger
+	requestTimeout time.Duration
+	pipelines      *pipeline.Registry
+	store          store.Store
+	// disconnectGrace is how long a message keeps running without a client
+	disconnectGrace time.Duration
+	runs            *runs
+	webhooks        *webhook.Sender
+	// batchConcurrency is how many batch items run at once by default
+	batchConcurrency int
+	jobLimit         int
+	jobTTL           time.Duration
+	jobs             *jobs
+	rateLimit        rate.Limit
+	rateBurst        int
 }
 
 type processRequest struct {
 	Message        string `json:"message"`
 	MessageID      string `json:"message_id"`
 	ConversationID string `json:"conversation_id,omitempty"`
+	// ShowReasoning forwards reasoning model thinking as "Reasoning" events
+	ShowReasoning bool `json:"show_reasoning,omitempty"`
+	// CompletionPolicy overrides the configured policy, e.g. "quorum:1"
+	CompletionPolicy string `json:"completion_policy,omitempty"`
+	// Pipeline names the pipeline to run; empty selects the default
+	Pipeline string `json:"pipeline,omitempty"`
+	// StreamAgents overrides whether agent tokens are streamed
+	StreamAgents *bool `json:"stream_agents,omitempty"`
+	// Combine overrides the pipeline's combine strategy, e.g. "judge"
+	Combine string `json:"combine,omitempty"`
+	// Locale is passed to prompt templates, e.g. "de-DE"
+	Locale string `json:"locale,omitempty"`
+	// WebhookURL is sent the final result once the message has completed
+	// or failed
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+func (req processRequest) options() ([]service.ProcessOption, error) {
+	var opts []service.ProcessOption
+	if req.ShowReasoning {
+		opts = append(opts, service.WithReasoning(service.ReasoningForward))
+	}
+	if req.StreamAgents != nil {
+		opts = append(opts, service.WithStreamAgents(*req.StreamAgents))
+	}
+	if req.Locale != "" {
+		opts = append(opts, service.WithLocale(req.Locale))
+	}
+	if req.Combine != "" {
+		combiner, err := service.ParseCombiner(req.Combine)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, service.WithCombiner(combiner))
+	}
+	if req.CompletionPolicy != "" {
+		policy, err := service.ParsePolicy(req.CompletionPolicy)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, service.WithPolicy(policy))
+	}
+	return opts, nil
+}
+
+// hash identifies the request by its content, to tell a retry from another
+// request reusing its message ID.
+func (req processRequest) hash() string {
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// processOptions adds the handler's own per-request options to those of req.
+func (h *Handler) processOptions(req processRequest) ([]service.ProcessOption, error) {
+	opts, err := req.options()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, service.WithRequestHash(req.hash()))
+	if req.WebhookURL == "" {
+		return opts, nil
+	}
+
+	if h.webhooks == nil {
+		return nil, errors.New("webhooks are not enabled")
+	}
+	u, err := url.Parse(req.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook_url %q", req.WebhookURL)
+	}
+	return append(opts, service.WithOnEnd(func(m store.Message) {
+		h.webhooks.Deliver(req.WebhookURL, webhook.NewPayload(m))
+	})), nil
 }
 
 func (h *Handler) ProcessMessage(w http.ResponseWriter, r *http.Request) {
@@ -37,87 +139,400 @@ func (h *Handler) ProcessMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	// A retry after a dropped connection may say what it has already seen
+	after, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	opts, err := h.processOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	eventChan := make(chan service.StatusEvent)
-	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	p, err := h.pipelines.Get(req.Pipeline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The pipeline outlives the connection so a client that drops can
+	// reconnect; the run is cancelled once nobody has watched it for the
+	// grace period
+	c, err := h.claim(r.Context(), context.WithoutCancel(r.Context()), req, false)
+	if err != nil {
+		h.claimError(w, err)
+		return
+	}
+	switch {
+	case c.stored != nil:
+		h.logger.Info("Replaying stored message", zap.String("message_id", req.MessageID))
+		h.replay(w, flusher, *c.stored)
+	case c.ctx == nil:
+		h.logger.Info("Attaching duplicate request", zap.String("message_id", req.MessageID))
+		h.stream(w, r, flusher, c.run, after)
+	default:
+		go h.execute(c.ctx, c.cancel, c.run, req, p, opts, nil)
+		h.stream(w, r, flusher, c.run, 0)
+	}
+}
+
+// claimed is what a request gets for its message ID: the stored record of a
+// message that has completed before, or the message's run. The run is new
+// and must be executed in ctx when ctx is set; otherwise it was started by
+// an earlier request with the same body, and is followed instead.
+type claimed struct {
+	stored *store.Message
+	run    *run
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// claim dedupes req by its message ID, whatever endpoint it came in on: it
+// returns the message's existing run or stored record, or starts a new run
+// in parent if the message is new or has failed. A request whose body
+// differs from the one that started the message fails with errConflict.
+func (h *Handler) claim(ctx, parent context.Context, req processRequest, background bool) (claimed, error) {
+	hash := req.hash()
+	for {
+		run, stored, err := h.lookup(ctx, req.MessageID, hash)
+		if err != nil || run != nil || stored != nil {
+			return claimed{run: run, stored: stored}, err
+		}
+
+		runCtx, cancel, run, err := h.startRun(parent, req.MessageID, hash, background)
+		if errors.Is(err, errRunning) {
+			// A duplicate request started it first; attach to that
+			continue
+		}
+		if err != nil {
+			return claimed{}, err
+		}
+		return claimed{run: run, ctx: runCtx, cancel: cancel}, nil
+	}
+}
+
+var errConflict = errors.New("was sent with a different body")
+
+// lookup finds what is known of a message: the run to attach to, or the
+// record of a completed message to replay. Both are nil if the message
+// should be processed, as it is new or failed.
+func (h *Handler) lookup(ctx context.Context, messageID, hash string) (*run, *store.Message, error) {
+	if run, ok := h.runs.get(messageID); ok {
+		if run.hash != hash {
+			return nil, nil, fmt.Errorf("message %q %w", messageID, errConflict)
+		}
+		if run.failed() {
+			return nil, nil, nil
+		}
+		return run, nil, nil
+	}
+	if h.store == nil {
+		return nil, nil, nil
+	}
+
+	m, err := h.store.Message(ctx, messageID)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return nil, nil, nil
+	case err != nil:
+		return nil, nil, err
+	// Messages stored before hashes were recorded can't be compared
+	case m.RequestHash != "" && m.RequestHash != hash:
+		return nil, nil, fmt.Errorf("message %q %w", messageID, errConflict)
+	case m.Status != store.StatusCompleted:
+		return nil, nil, nil
+	}
+	return nil, &m, nil
+}
+
+// claimError answers a request whose message couldn't be claimed.
+func (h *Handler) claimError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errShuttingDown):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		h.storeError(w, "message", err)
+	}
+}
+
+// replay streams the stored answer of a completed message.
+func (h *Handler) replay(w http.ResponseWriter, flusher http.Flusher, m store.Message) {
+	sseHeaders(w)
+	w.Header().Set("Idempotent-Replayed", "true")
+
+	enc := json.NewEncoder(w)
+	for i, ev := range storedEvents(m) {
+		if err := writeEvent(w, enc, i+1, ev); err != nil {
+			h.logger.Error("encoding SSE", zap.Error(err))
+			return
+		}
+	}
+	flusher.Flush()
+}
+
+// storedEvents retells a completed message as a single Streaming event with
+// its answer and a closing Completed event.
+func storedEvents(m store.Message) []service.StatusEvent {
+	return []service.StatusEvent{
+		{MessageID: m.ID, ConversationID: m.ConversationID, Status: service.StatusStreaming, Message: m.Answer},
+		{MessageID: m.ID, ConversationID: m.ConversationID, Status: service.StatusCompleted, Usage: &m.Usage, Final: true},
+	}
+}
+
+// follow passes the events of run to observe, from the start, until it
+// finishes or ctx is done. A followed run is watched, so it isn't cancelled
+// for want of a client.
+func follow(ctx context.Context, run *run, observe func(service.StatusEvent)) error {
+	run.attach()
+	defer run.detach()
+
+	var after int
+	for {
+		events, done, changed := run.since(after)
+		for _, e := range events {
+			observe(e.event)
+			after = e.id
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// ResumeMessage reconnects to the stream of a running or just finished
+// message, replaying the events after the Last-Event-ID header (or the
+// last_event_id query parameter) before continuing live.
+func (h *Handler) ResumeMessage(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	messageID := chi.URLParam(r, "message_id")
+	run, ok := h.runs.get(messageID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("message %q is not running", messageID), http.StatusNotFound)
+		return
+	}
+
+	after, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	h.stream(w, r, flusher, run, after)
+}
+
+// lastEventID reads the ID of the last event a reconnecting client saw, 0 if
+// it hasn't seen any.
+func lastEventID(r *http.Request) (int, error) {
+	v := cmp.Or(r.Header.Get("Last-Event-ID"), r.URL.Query().Get("last_event_id"))
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err == nil && id < 0 {
+		err = fmt.Errorf("negative event ID %d", id)
+	}
+	return id, err
+}
+
+// cancelWait is how long CancelMessage waits for the pipeline to stop.
+const cancelWait = 10 * time.Second
+
+// CancelMessage cancels a running message. It answers with the terminal
+// cancelled event, telling how far the pipeline got, once it has stopped,
+// or with 202 and a "cancelling" status if it doesn't stop in time.
+func (h *Handler) CancelMessage(w http.ResponseWriter, r *http.Request) {
+	messageID := chi.URLParam(r, "message_id")
+	run, ok := h.runs.get(messageID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("message %q is not running", messageID), http.StatusNotFound)
+		return
+	}
+	if !run.stop(service.ErrCancelled) {
+		http.Error(w, fmt.Sprintf("message %q has already finished", messageID), http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cancelWait)
 	defer cancel()
+	last, err := run.wait(ctx)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		h.writeJSON(w, map[string]string{"message_id": messageID, "status": "cancelling"})
+		return
+	}
+	// The pipeline may have finished before the cancellation reached it
+	status := http.StatusOK
+	if last.Status != service.StatusCancelled {
+		status = http.StatusConflict
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	h.writeJSON(w, last)
+}
 
+// startRun registers a run for messageID, failing as runs.start does, and
+// returns the context to run its pipeline in, bounded by the request
+// timeout.
+func (h *Handler) startRun(
+	parent context.Context,
+	messageID, hash string,
+	background bool,
+) (context.Context, context.CancelFunc, *run, error) {
+	ctx, cancelRun := context.WithCancelCause(parent)
+	run, err := h.runs.start(messageID, hash, cancelRun, background)
+	if err != nil {
+		cancelRun(nil)
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.requestTimeout)
+	return ctx, func() {
+		cancel()
+		cancelRun(nil)
+	}, run, nil
+}
+
+// Drain cancels the messages still running, including background jobs and
+// batches, and waits for them to record their outcome or ctx to be done.
+// New messages are refused from then on.
+func (h *Handler) Drain(ctx context.Context) error {
+	return h.runs.drain(ctx)
+}
+
+// execute runs the pipeline of a message and publishes its events to run,
+// passing each to observe first when it is set.
+func (h *Handler) execute(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	run *run,
+	req processRequest,
+	p *service.Pipeline,
+	opts []service.ProcessOption,
+	observe func(service.StatusEvent),
+) {
+	defer cancel()
+	defer h.runs.finish(run)
+
+	eventChan := make(chan service.StatusEvent)
 	go func() {
 		defer close(eventChan)
 
-		tasks := createPromptTasks(req.Message)
-
-		if err := h.svc.ProcessMessage(
+		if err := h.svc.RunPipeline(
 			ctx,
 			req.MessageID,
 			req.ConversationID,
-			tasks,
+			req.Message,
+			p,
 			eventChan,
-		); err != nil {
-			h.logger.Error("processing message", zap.Error(err))
+			opts...,
+		); err != nil && !errors.Is(err, service.ErrCancelled) {
+			// A cancelled pipeline has reported so itself. The full error is
+			// only logged; clients get its class and a sanitized message
+			h.logger.Error("processing message", zap.String("message_id", req.MessageID), zap.Error(err))
 			eventChan <- service.StatusEvent{
-				Status:  "error",
-				Message: err.Error(),
+				MessageID:      req.MessageID,
+				ConversationID: req.ConversationID,
+				Status:         "error",
+				Message:        llm.ErrorMessage(err),
+				ErrorClass:     string(llm.ClassifyError(err)),
 			}
 		}
 	}()
 
+	for event := range eventChan {
+		if observe != nil {
+			observe(event)
+		}
+		run.publish(event)
+	}
+}
+
+// stream writes the events of run after the given ID as SSE frames, then
+// follows it live until it finishes or the client disconnects.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request, flusher http.Flusher, run *run, after int) {
+	sseHeaders(w)
+
+	// The server's WriteTimeout is sized for ordinary requests; let the
+	// stream live as long as the request is allowed to run
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(h.requestTimeout + 5*time.Second)); err != nil {
+		h.logger.Warn("extending write deadline", zap.Error(err))
+	}
+
+	run.attach()
+	defer run.detach()
+
 	enc := json.NewEncoder(w)
 	for {
-		select {
-		case <-ctx.Done():
-			h.logger.Warn("client disconnected")
-			return
-		case event, ok := <-eventChan:
-			if !ok {
-				return
-			}
-			w.Write([]byte("data: "))
-			if err := enc.Encode(event); err != nil {
+		events, done, changed := run.since(after)
+		for _, e := range events {
+			if err := writeEvent(w, enc, e.id, e.event); err != nil {
 				h.logger.Error("encoding SSE", zap.Error(err))
 				return
 			}
-			w.Write([]byte("\n"))
-			flusher.Flush()
-			// time.Sleep(300 * time.Millisecond) // For small throttling
-		}
-	}
-}
-
-func createPromptTasks(message string) []service.PromptTask {
-	return []service.PromptTask{
-		{
-			ID: "llm-1",
-			Prompt: []llm.ChatMessage{
-				{Role: "system", Content: `
-				You are LLM 1. For each response:
-				- Approach every question and problem with creativity and originality.
-				- Explore novel ideas, unconventional solutions, and imaginative perspectives.
-				- Don't limit yourself to standard or obvious answers—think broadly and innovatively.
-				- When appropriate, use metaphors, analogies, or storytelling to illustrate your points and make your explanations engaging.
-				- Present your ideas clearly and confidently, encouraging curiosity and inspiration in the user.
-				`},
-				{Role: "user", Content: message},
-			},
-		},
-		{
-			ID: "llm-2",
-			Prompt: []llm.ChatMessage{
-				{Role: "system", Content: `
-				You are LLM 2. For each response:
-				- Ensure all information is accurate, verifiable, and based on reliable sources.
-				- If a claim or fact cannot be verified, explicitly state the uncertainty or lack of evidence.
-				- Do not provide answers solely based on internal confidence; support your conclusions with proof, reasoning, or referenced data when possible.
-				- Reason through complex problems step by step, and quote or cite your sources where appropriate.
-				- Present responses clearly, precisely, and with careful fact-checking.
-				`},
-				{Role: "user", Content: message},
+			after = e.id
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			h.logger.Warn("client disconnected", zap.String("message_id", run.messageID), zap.Int("last_event_id", after))
+			return
+		case <-changed:
+		}
+	}
+}
+
+func sseHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// writeEvent writes ev as an SSE frame with the given id.
+func writeEvent(w io.Writer, enc *json.Encoder, id int, ev service.StatusEvent) error {
+	fmt.Fprintf(w, "id: %d\ndata: ", id)
+	if err := enc.Encode(ev); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\n"))
+	return err
+}
+
+// defaultPipeline asks the creative and fact-checking agents in parallel and
+// combines their answers.
+func defaultPipeline() *service.Pipeline {
+	return &service.Pipeline{
+		Name: "default",
+		Stages: []service.Stage{
+			{
+				ID: "agents",
+				Tasks: service.TemplateTasks(
+					service.TaskTemplate{ID: "llm-1", SystemID: prompt.AgentCreative},
+					service.TaskTemplate{ID: "llm-2", SystemID: prompt.AgentFactual},
+				),
 			},
+			service.CombineStage("combine", nil, "agents"),
 		},
 	}
 }
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"llmsse/internal/store"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// messageResponse is a stored message with how long it took to answer.
+type messageResponse struct {
+	store.Message
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+func newMessageResponse(m store.Message) messageResponse {
+	res := messageResponse{Message: m}
+	if m.CompletedAt != nil {
+		res.DurationMS = m.CompletedAt.Sub(m.CreatedAt).Milliseconds()
+	}
+	return res
+}
+
+type conversationResponse struct {
+	store.Conversation
+	Messages []messageResponse `json:"messages"`
+}
+
+type conversationsResponse struct {
+	Conversations []store.Conversation `json:"conversations"`
+	// NextOffset is set when there are more conversations to page through
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+func (h *Handler) GetMessage(w http.ResponseWriter, r *http.Request) {
+	if !h.hasStore(w) {
+		return
+	}
+	m, err := h.store.Message(r.Context(), chi.URLParam(r, "message_id"))
+	if err != nil {
+		h.storeError(w, "message", err)
+		return
+	}
+	h.writeJSON(w, newMessageResponse(m))
+}
+
+func (h *Handler) GetConversation(w http.ResponseWriter, r *http.Request) {
+	if !h.hasStore(w) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	c, err := h.store.Conversation(r.Context(), id)
+	if err != nil {
+		h.storeError(w, "conversation", err)
+		return
+	}
+	messages, err := h.store.Messages(r.Context(), id)
+	if err != nil {
+		h.storeError(w, "conversation", err)
+		return
+	}
+
+	res := conversationResponse{Conversation: c, Messages: make([]messageResponse, len(messages))}
+	for i, m := range messages {
+		res.Messages[i] = newMessageResponse(m)
+	}
+	h.writeJSON(w, res)
+}
+
+// ListConversations pages through conversations, most recently updated
+// first, with the limit and offset query parameters.
+func (h *Handler) ListConversations(w http.ResponseWriter, r *http.Request) {
+	if !h.hasStore(w) {
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxPageSize), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	// One extra row tells whether there is another page
+	conversations, err := h.store.Conversations(r.Context(), limit+1, offset)
+	if err != nil {
+		h.storeError(w, "conversations", err)
+		return
+	}
+	res := conversationsResponse{Conversations: conversations}
+	if len(conversations) > limit {
+		res.Conversations = conversations[:limit]
+		next := offset + limit
+		res.NextOffset = &next
+	}
+	h.writeJSON(w, res)
+}
+
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// hasStore answers 503 when there is no store to read from.
+func (h *Handler) hasStore(w http.ResponseWriter) bool {
+	if h.store == nil {
+		http.Error(w, "no store is configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) storeError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, what+" not found", http.StatusNotFound)
+		return
+	}
+	h.logger.Error("reading "+what, zap.Error(err))
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.logger.Error("encoding response", zap.Error(err))
+	}
+}
@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	srv := newStoreServer(t, &stubLLM{})
+	for i := range 3 {
+		id := strconv.Itoa(i + 1)
+		res := post(t, srv, "/api/process", map[string]string{"message": "q" + id, "message_id": "msg-" + id, "conversation_id": "conv-" + id})
+		require.Equal(t, service.StatusCompleted, last(readEvents(t, res.Body)).Status)
+	}
+
+	t.Run("message", func(t *testing.T) {
+		res := get(t, srv, "/api/messages/msg-1")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var m struct {
+			ConversationID string `json:"conversation_id"`
+			Content        string `json:"content"`
+			Answer         string `json:"answer"`
+			Status         string `json:"status"`
+			Outputs        []struct {
+				Agent string `json:"agent"`
+			} `json:"outputs"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&m))
+		require.Equal(t, "conv-1", m.ConversationID)
+		require.Equal(t, "q1", m.Content)
+		require.Equal(t, "tok0 ", m.Answer)
+		require.Equal(t, "completed", m.Status)
+		require.NotEmpty(t, m.Outputs)
+
+		require.Equal(t, http.StatusNotFound, get(t, srv, "/api/messages/msg-9").StatusCode)
+	})
+
+	t.Run("conversation", func(t *testing.T) {
+		res := get(t, srv, "/api/conversations/conv-2")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var c struct {
+			ID       string `json:"id"`
+			Count    int    `json:"message_count"`
+			Messages []struct {
+				ID string `json:"id"`
+			} `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&c))
+		require.Equal(t, "conv-2", c.ID)
+		require.Equal(t, 1, c.Count)
+		require.Len(t, c.Messages, 1)
+		require.Equal(t, "msg-2", c.Messages[0].ID)
+
+		require.Equal(t, http.StatusNotFound, get(t, srv, "/api/conversations/conv-9").StatusCode)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		type page struct {
+			Conversations []struct {
+				ID string `json:"id"`
+			} `json:"conversations"`
+			NextOffset *int `json:"next_offset"`
+		}
+		list := func(query string) page {
+			res := get(t, srv, "/api/conversations"+query)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			var p page
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&p))
+			return p
+		}
+
+		// Most recently updated first
+		first := list("?limit=2")
+		require.Len(t, first.Conversations, 2)
+		require.Equal(t, "conv-3", first.Conversations[0].ID)
+		require.NotNil(t, first.NextOffset)
+		require.Equal(t, 2, *first.NextOffset)
+
+		rest := list("?limit=2&offset=2")
+		require.Len(t, rest.Conversations, 1)
+		require.Equal(t, "conv-1", rest.Conversations[0].ID)
+		require.Nil(t, rest.NextOffset)
+
+		res := get(t, srv, "/api/conversations?offset=10")
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"conversations": []}`, string(body))
+
+		for _, query := range []string{"?limit=0", "?limit=101", "?limit=x", "?offset=-1"} {
+			require.Equal(t, http.StatusBadRequest, get(t, srv, "/api/conversations"+query).StatusCode, query)
+		}
+	})
+}
+
+func TestHistory_NoStore(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{})
+	for _, path := range []string{"/api/messages/msg-1", "/api/conversations/conv-1", "/api/conversations"} {
+		require.Equal(t, http.StatusServiceUnavailable, get(t, srv, path).StatusCode, path)
+	}
+}
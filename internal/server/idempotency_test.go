@@ -0,0 +1,123 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"llmsse/internal/server"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	request = `{"message": "q", "message_id": "msg-1"}`
+	other   = `{"message": "other", "message_id": "msg-1"}`
+)
+
+func TestIdempotency_Attach(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv := newStoreServer(t, stub)
+
+	first := post(t, srv, "/api/process", json.RawMessage(request))
+	require.Equal(t, http.StatusOK, first.StatusCode)
+
+	// Duplicates on every endpoint join the running message
+	second := post(t, srv, "/api/process", json.RawMessage(request))
+	require.Equal(t, http.StatusOK, second.StatusCode)
+	res, job := createJob(t, srv, json.RawMessage(request))
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	batch := make(chan []batchLine)
+	go func() { batch <- postBatch(t, srv, request) }()
+
+	// Give the batch time to attach before the run ends
+	time.Sleep(50 * time.Millisecond)
+	close(stub.gate)
+
+	require.Equal(t, readEvents(t, first.Body), readEvents(t, second.Body))
+	require.Equal(t, "completed", pollJob(t, srv, job.ID).Status)
+	lines := <-batch
+	require.Equal(t, "completed", lines[0].Status)
+	require.Equal(t, "tok0 ", lines[0].Answer)
+
+	calls, _ := stub.counts()
+	require.Equal(t, 2, calls, "the message ran once")
+}
+
+func TestIdempotency_AttachResumes(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv := newStoreServer(t, stub)
+
+	first := post(t, srv, "/api/process", json.RawMessage(request))
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	// A retry after a dropped connection carries the last event it saw
+	retry := post(t, srv, "/api/process", json.RawMessage(request), "Last-Event-ID", "1")
+	require.Equal(t, http.StatusOK, retry.StatusCode)
+	invalid := post(t, srv, "/api/process", json.RawMessage(request), "Last-Event-ID", "x")
+	require.Equal(t, http.StatusBadRequest, invalid.StatusCode)
+	close(stub.gate)
+
+	all := readEvents(t, first.Body)
+	require.Equal(t, all[1:], readEvents(t, retry.Body))
+}
+
+func TestIdempotency_Replay(t *testing.T) {
+	stub := &stubLLM{}
+	srv := newStoreServer(t, stub, server.WithDisconnectGrace(10*time.Millisecond))
+
+	require.Equal(t, service.StatusCompleted, last(readEvents(t, post(t, srv, "/api/process", json.RawMessage(request)).Body)).Status)
+	// Once the run is forgotten, the stored record answers duplicates
+	require.Eventually(t, func() bool {
+		return get(t, srv, "/api/process/msg-1").StatusCode == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+
+	res := post(t, srv, "/api/process", json.RawMessage(request))
+	require.Equal(t, "true", res.Header.Get("Idempotent-Replayed"))
+	events := readEvents(t, res.Body)
+	require.Equal(t, "tok0 ", events[0].event.Message)
+	require.Equal(t, service.StatusCompleted, last(events).Status)
+
+	res, job := createJob(t, srv, json.RawMessage(request))
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	require.Equal(t, "true", res.Header.Get("Idempotent-Replayed"))
+	require.Equal(t, "completed", job.Status)
+	require.Equal(t, "tok0 ", job.Answer)
+	require.Equal(t, service.StatusCompleted, last(readEvents(t, get(t, srv, "/api/jobs/"+job.ID+"/events").Body)).Status)
+
+	lines := postBatch(t, srv, request)
+	require.Equal(t, "completed", lines[0].Status)
+	require.Equal(t, "tok0 ", lines[0].Answer)
+
+	calls, _ := stub.counts()
+	require.Equal(t, 2, calls, "the message ran once")
+}
+
+func TestIdempotency_Conflict(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv := newStoreServer(t, stub, server.WithDisconnectGrace(10*time.Millisecond))
+
+	conflicts := func(t *testing.T) {
+		t.Helper()
+		require.Equal(t, http.StatusConflict, post(t, srv, "/api/process", json.RawMessage(other)).StatusCode)
+		res, _ := createJob(t, srv, json.RawMessage(other))
+		require.Equal(t, http.StatusConflict, res.StatusCode)
+		lines := postBatch(t, srv, other)
+		require.Equal(t, "failed", lines[0].Status)
+		require.Contains(t, lines[0].Error, "different body")
+	}
+
+	first := post(t, srv, "/api/process", json.RawMessage(request))
+	t.Run("running", conflicts)
+
+	close(stub.gate)
+	readEvents(t, first.Body)
+	require.Eventually(t, func() bool {
+		return get(t, srv, "/api/process/msg-1").StatusCode == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+	t.Run("stored", conflicts)
+
+	calls, _ := stub.counts()
+	require.Equal(t, 2, calls, "the message ran once")
+}
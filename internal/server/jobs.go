@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/service"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var errTooManyJobs = errors.New("too many jobs")
+
+// outcome is what the events of a message add up to.
+type outcome struct {
+	status      string
+	answer      strings.Builder
+	usage       *llm.Usage
+	template    string
+	err         string
+	errorClass  string
+	completedAt *time.Time
+}
+
+func (o *outcome) record(ev service.StatusEvent) {
+	switch {
+	case ev.Status == service.StatusStreaming:
+		o.answer.WriteString(ev.Message)
+	case ev.Status == service.StatusCompleted && ev.Final:
+		o.status, o.usage, o.template = jobCompleted, ev.Usage, ev.Template
+		o.complete()
+	case ev.Status == service.StatusCancelled:
+		o.status, o.err = jobCancelled, service.ErrCancelled.Error()
+		o.complete()
+	case ev.Status == "error":
+		o.status, o.err, o.errorClass = jobFailed, ev.Message, ev.ErrorClass
+		o.complete()
+	}
+}
+
+// fail ends the outcome with err. Only errors the caller caused, which
+// /api/process answers with in full as well, keep their text; others may
+// carry internals and are described as in error events.
+func (o *outcome) fail(err error) {
+	o.status = jobFailed
+	switch {
+	case errors.Is(err, errInvalidItem), errors.Is(err, errConflict):
+		o.err, o.errorClass = err.Error(), string(llm.ErrorClassInvalidRequest)
+	case errors.Is(err, errShuttingDown):
+		o.err, o.errorClass = err.Error(), string(llm.ErrorClassCancelled)
+	default:
+		o.err, o.errorClass = llm.ErrorMessage(err), string(llm.ClassifyError(err))
+	}
+	o.complete()
+}
+
+func (o *outcome) complete() {
+	now := time.Now()
+	o.completedAt = &now
+}
+
+// job is a message processed in the background. Its events are kept in run
+// for subscribers, and the outcome is collected as they pass.
+type job struct {
+	id        string
+	req       processRequest
+	run       *run
+	createdAt time.Time
+
+	mu sync.Mutex
+	outcome
+}
+
+type jobResponse struct {
+	ID             string     `json:"id"`
+	MessageID      string     `json:"message_id"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	Pipeline       string     `json:"pipeline,omitempty"`
+	Status         string     `json:"status"`
+	Answer         string     `json:"answer,omitempty"`
+	Template       string     `json:"template,omitempty"`
+	Usage          *llm.Usage `json:"usage,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	ErrorClass     string     `json:"error_class,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// record folds an event of the job's pipeline into its outcome.
+func (j *job) record(ev service.StatusEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.outcome.record(ev)
+}
+
+func (j *job) view() jobResponse {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return jobResponse{
+		ID:             j.id,
+		MessageID:      j.req.MessageID,
+		ConversationID: j.req.ConversationID,
+		Pipeline:       j.req.Pipeline,
+		Status:         j.status,
+		Answer:         j.answer.String(),
+		Template:       j.template,
+		Usage:          j.usage,
+		Error:          j.err,
+		ErrorClass:     j.errorClass,
+		CreatedAt:      j.createdAt,
+		CompletedAt:    j.completedAt,
+	}
+}
+
+// expired reports whether j finished more than ttl ago.
+func (j *job) expired(now time.Time, ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.completedAt != nil && now.Sub(*j.completedAt) > ttl
+}
+
+func (j *job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.completedAt != nil
+}
+
+// jobs is a bounded table of jobs. Finished jobs are evicted once their TTL
+// has passed, or oldest first when the table is full; running jobs are never
+// evicted, so a table full of them turns new jobs away.
+type jobs struct {
+	limit int
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	byID  map[string]*job
+	order []*job
+}
+
+func newJobs(limit int, ttl time.Duration) *jobs {
+	return &jobs{limit: limit, ttl: ttl, byID: make(map[string]*job)}
+}
+
+func (js *jobs) add(j *job) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.evict(time.Now())
+	if len(js.order) >= js.limit {
+		for i, old := range js.order {
+			if old.finished() {
+				js.remove(i)
+				break
+			}
+		}
+	}
+	if len(js.order) >= js.limit {
+		return errTooManyJobs
+	}
+	js.byID[j.id] = j
+	js.order = append(js.order, j)
+	return nil
+}
+
+func (js *jobs) get(id string) (*job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.evict(time.Now())
+	j, ok := js.byID[id]
+	return j, ok
+}
+
+// evict drops the expired jobs; js.mu must be held.
+func (js *jobs) evict(now time.Time) {
+	for i := 0; i < len(js.order); {
+		if js.order[i].expired(now, js.ttl) {
+			js.remove(i)
+			continue
+		}
+		i++
+	}
+}
+
+// remove drops the i-th job; js.mu must be held.
+func (js *jobs) remove(i int) {
+	delete(js.byID, js.order[i].id)
+	js.order = append(js.order[:i], js.order[i+1:]...)
+}
+
+// CreateJob starts processing a message in the background and answers at
+// once with the job's ID. The message ID defaults to the job ID.
+func (h *Handler) CreateJob(w http.ResponseWriter, r *http.Request) {
+	var req processRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := "job_" + strings.ToLower(rand.Text())
+	if req.MessageID == "" {
+		req.MessageID = id
+	}
+
+	opts, err := h.processOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := h.pipelines.Get(req.Pipeline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Nobody watches a job, so it keeps going until it finishes, times out
+	// or is cancelled
+	c, err := h.claim(r.Context(), context.WithoutCancel(r.Context()), req, true)
+	if err != nil {
+		h.claimError(w, err)
+		return
+	}
+	j := &job{id: id, req: req, run: c.run, createdAt: time.Now()}
+	j.status = jobRunning
+	if c.stored != nil {
+		// The job's events are the stored message retold
+		j.run = finishedRun(c.stored.ID, storedEvents(*c.stored))
+		for _, ev := range storedEvents(*c.stored) {
+			j.record(ev)
+		}
+	}
+	if err := h.jobs.add(j); err != nil {
+		if c.ctx != nil {
+			c.cancel()
+			h.runs.discard(c.run)
+		}
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case c.stored != nil:
+		w.Header().Set("Idempotent-Replayed", "true")
+	case c.ctx == nil:
+		// Another request started the message; the job follows it
+		go follow(context.Background(), c.run, j.record)
+	default:
+		go h.execute(c.ctx, c.cancel, c.run, req, p, opts, j.record)
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	h.writeJSON(w, j.view())
+}
+
+// GetJob returns a job's status, and its answer once it has completed.
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := h.jobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	h.writeJSON(w, j.view())
+}
+
+// JobEvents streams a job's events over SSE, from the start or from after
+// Last-Event-ID, and follows it live until it finishes.
+func (h *Handler) JobEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	j, ok := h.jobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	after, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	h.stream(w, r, flusher, j.run, after)
+}
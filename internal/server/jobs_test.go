@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"llmsse/internal/server"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{tokens: 3})
+
+	res, created := createJob(t, srv, map[string]string{"message": "q"})
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	require.True(t, strings.HasPrefix(created.ID, "job_"))
+	require.Equal(t, "/api/jobs/"+created.ID, res.Header.Get("Location"))
+	require.Equal(t, created.ID, created.MessageID, "the message ID defaults to the job's")
+	require.Equal(t, "running", created.Status)
+
+	done := pollJob(t, srv, created.ID)
+	require.Equal(t, "completed", done.Status)
+	require.Equal(t, "tok0 tok1 tok2 ", done.Answer)
+	require.NotNil(t, done.Usage)
+
+	events := readEvents(t, get(t, srv, "/api/jobs/"+created.ID+"/events").Body)
+	require.Equal(t, service.StatusCompleted, last(events).Status)
+	require.True(t, last(events).Final)
+	replayed := readEvents(t, get(t, srv, "/api/jobs/"+created.ID+"/events", "Last-Event-ID", "2").Body)
+	require.Equal(t, events[2:], replayed)
+
+	require.Equal(t, http.StatusNotFound, get(t, srv, "/api/jobs/job_unknown").StatusCode)
+	require.Equal(t, http.StatusNotFound, get(t, srv, "/api/jobs/job_unknown/events").StatusCode)
+	res, _ = createJob(t, srv, map[string]string{"message": ""})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestJobs_EventsFollowRunningJob(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv, _ := newServer(t, stub)
+
+	_, created := createJob(t, srv, map[string]string{"message": "q"})
+	events := get(t, srv, "/api/jobs/"+created.ID+"/events")
+	require.Equal(t, http.StatusOK, events.StatusCode)
+	close(stub.gate)
+
+	require.Equal(t, service.StatusCompleted, last(readEvents(t, events.Body)).Status)
+}
+
+func TestJobs_TTL(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{}, server.WithJobs(10, 20*time.Millisecond))
+
+	_, created := createJob(t, srv, map[string]string{"message": "q"})
+	require.Equal(t, "completed", pollJob(t, srv, created.ID).Status)
+	require.Eventually(t, func() bool {
+		return get(t, srv, "/api/jobs/"+created.ID).StatusCode == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestJobs_Limit(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv, _ := newServer(t, stub, server.WithJobs(1, time.Hour))
+
+	_, first := createJob(t, srv, map[string]string{"message": "q"})
+	// A running job is never evicted to make room
+	res, _ := createJob(t, srv, map[string]string{"message": "q"})
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	close(stub.gate)
+	require.Equal(t, "completed", pollJob(t, srv, first.ID).Status)
+	// A finished one is, oldest first
+	res, second := createJob(t, srv, map[string]string{"message": "q"})
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+	require.Equal(t, http.StatusNotFound, get(t, srv, "/api/jobs/"+first.ID).StatusCode)
+	require.Equal(t, "completed", pollJob(t, srv, second.ID).Status)
+}
@@ -0,0 +1,36 @@
+package server_test
+
+import (
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/llm/llmtest"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestProcessMessage_ShowReasoning(t *testing.T) {
+	provider := llmtest.NewServer(t, llmtest.Scenario{Reasoning: []string{"thinking "}, Chunks: []string{"answer"}})
+	client := llm.NewClient("key", "model", provider.URL, zap.NewNop())
+	srv, _ := serve(t, service.NewService(client, zap.NewNop()))
+
+	reasoning := func(body map[string]any) []string {
+		t.Helper()
+		var got []string
+		events := readEvents(t, post(t, srv, "/api/process", body).Body)
+		require.Equal(t, service.StatusCompleted, last(events).Status)
+		for _, e := range events {
+			if e.event.Status == service.StatusReasoning {
+				got = append(got, e.event.Source+": "+e.event.Message)
+			}
+		}
+		return got
+	}
+
+	// Agents call, and the combiner streams, so both kinds of response count
+	require.ElementsMatch(t, []string{"llm-1: thinking ", "llm-2: thinking ", "llm-combine: thinking "},
+		reasoning(map[string]any{"message": "q", "message_id": "msg-1", "show_reasoning": true}))
+	require.Empty(t, reasoning(map[string]any{"message": "q", "message_id": "msg-2"}), "reasoning is hidden by default")
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"llmsse/internal/pipeline"
 	"llmsse/internal/server/middleware"
 	"llmsse/internal/service"
+	"llmsse/internal/store"
+	"llmsse/internal/webhook"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -10,16 +13,109 @@ import (
 	"golang.org/x/time/rate"
 )
 
-func NewRouter(svc *service.Service, logger *zap.Logger) *chi.Mux {
+type RouterOption func(*Handler)
+
+// WithRequestTimeout bounds how long a single request may run end to end.
+func WithRequestTimeout(d time.Duration) RouterOption {
+	return func(h *Handler) {
+		h.requestTimeout = d
+	}
+}
+
+// WithPipelines sets the pipelines requests can choose from.
+func WithPipelines(r *pipeline.Registry) RouterOption {
+	return func(h *Handler) {
+		h.pipelines = r
+	}
+}
+
+// WithDisconnectGrace sets how long a message keeps running after its
+// client disconnected, waiting for it to reconnect, and how long the events
+// of a finished message can still be replayed.
+func WithDisconnectGrace(d time.Duration) RouterOption {
+	return func(h *Handler) {
+		h.disconnectGrace = d
+	}
+}
+
+// WithJobs bounds the async jobs kept at once, and how long a finished job
+// is kept.
+func WithJobs(limit int, ttl time.Duration) RouterOption {
+	return func(h *Handler) {
+		h.jobLimit, h.jobTTL = limit, ttl
+	}
+}
+
+// WithWebhooks lets requests name a webhook_url that s notifies once they
+// have finished.
+func WithWebhooks(s *webhook.Sender) RouterOption {
+	return func(h *Handler) {
+		h.webhooks = s
+	}
+}
+
+// WithBatchConcurrency sets how many items of a batch run at once unless
+// the request asks for another limit.
+func WithBatchConcurrency(n int) RouterOption {
+	return func(h *Handler) {
+		h.batchConcurrency = n
+	}
+}
+
+// WithRateLimit sets the requests per second each client IP may send, and
+// the burst it may send at once.
+func WithRateLimit(r rate.Limit, burst int) RouterOption {
+	return func(h *Handler) {
+		h.rateLimit, h.rateBurst = r, burst
+	}
+}
+
+// WithStore serves stored messages and conversations from st. Without it,
+// their endpoints answer 503.
+func WithStore(st store.Store) RouterOption {
+	return func(h *Handler) {
+		h.store = st
+	}
+}
+
+// NewRouter returns the router and the Handler behind it, which the caller
+// drains on shutdown.
+func NewRouter(svc *service.Service, logger *zap.Logger, opts ...RouterOption) (*chi.Mux, *Handler) {
+	h := &Handler{
+		svc:              svc,
+		logger:           logger,
+		requestTimeout:   2 * time.Minute,
+		pipelines:        pipeline.NewRegistry("default", defaultPipeline()),
+		disconnectGrace:  30 * time.Second,
+		jobLimit:         1000,
+		jobTTL:           time.Hour,
+		batchConcurrency: 4,
+		rateLimit:        rate.Every(1 * time.Second),
+		rateBurst:        3,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
 	router := chi.NewRouter()
 
-	rateLimiter := middleware.NewRateLimiter(rate.Every(1*time.Second), 3, 5*time.Minute, logger)
+	rateLimiter := middleware.NewRateLimiter(h.rateLimit, h.rateBurst, 5*time.Minute, logger)
 
 	router.Use(rateLimiter.Middleware)
 
-	h := &Handler{svc: svc, logger: logger}
+	h.runs = newRuns(h.disconnectGrace)
+	h.jobs = newJobs(h.jobLimit, h.jobTTL)
 
 	router.Post("/api/process", h.ProcessMessage)
+	router.Get("/api/process/{message_id}", h.ResumeMessage)
+	router.Delete("/api/process/{message_id}", h.CancelMessage)
+	router.Post("/api/batch", h.ProcessBatch)
+	router.Post("/api/jobs", h.CreateJob)
+	router.Get("/api/jobs/{id}", h.GetJob)
+	router.Get("/api/jobs/{id}/events", h.JobEvents)
+	router.Get("/api/messages/{message_id}", h.GetMessage)
+	router.Get("/api/conversations", h.ListConversations)
+	router.Get("/api/conversations/{id}", h.GetConversation)
 
-	return router
+	return router, h
 }
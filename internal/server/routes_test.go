@@ -0,0 +1,29 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/server"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+func TestWithRateLimit(t *testing.T) {
+	svc := service.NewService(llm.NewMockClient(), zap.NewNop())
+	router, _ := server.NewRouter(svc, zap.NewNop(), server.WithRateLimit(rate.Every(time.Hour), 2))
+
+	codes := make([]int, 3)
+	for i := range codes {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/jobs/job_unknown", nil))
+		codes[i] = rec.Code
+	}
+	require.Equal(t, []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests}, codes)
+}
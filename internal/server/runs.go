@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"llmsse/internal/service"
+)
+
+// maxBufferedEvents bounds the events a run keeps for replay; a client that
+// reconnects further behind misses the oldest ones.
+const maxBufferedEvents = 1024
+
+// runEvent is an event with its SSE id, counted from 1 within a run.
+type runEvent struct {
+	id    int
+	event service.StatusEvent
+}
+
+// run is one pipeline execution, decoupled from the connection that started
+// it. Its events are buffered so a client can reconnect and catch up, and it
+// is cancelled once no client has watched it for the grace period, unless it
+// runs in the background.
+type run struct {
+	messageID string
+	// hash identifies the request that started the run
+	hash       string
+	cancel     context.CancelCauseFunc
+	background bool
+	grace      time.Duration
+
+	mu       sync.Mutex
+	events   []runEvent
+	lastID   int
+	done     bool
+	changed  chan struct{}
+	watchers int
+	orphaned *time.Timer
+}
+
+// finishedRun returns a run that has finished with events, for replaying
+// them. It isn't registered, as nothing is running.
+func finishedRun(messageID string, events []service.StatusEvent) *run {
+	r := &run{messageID: messageID, done: true, changed: make(chan struct{})}
+	for _, ev := range events {
+		r.lastID++
+		r.events = append(r.events, runEvent{id: r.lastID, event: ev})
+	}
+	return r
+}
+
+func (r *run) publish(ev service.StatusEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID++
+	r.events = append(r.events, runEvent{id: r.lastID, event: ev})
+	// Trim in batches so publishing stays cheap
+	if len(r.events) >= 2*maxBufferedEvents {
+		r.events = append([]runEvent(nil), r.events[len(r.events)-maxBufferedEvents:]...)
+	}
+	r.notify()
+}
+
+func (r *run) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done = true
+	if r.orphaned != nil {
+		r.orphaned.Stop()
+	}
+	r.notify()
+}
+
+func (r *run) finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done
+}
+
+// failed reports whether the run has finished without completing.
+func (r *run) failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.events)
+	return r.done && (n == 0 || r.events[n-1].event.Status != service.StatusCompleted)
+}
+
+// notify wakes every watcher; r.mu must be held.
+func (r *run) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// since returns the buffered events after id, whether the run has finished,
+// and a channel that is closed when there is more to read.
+func (r *run) since(id int) ([]runEvent, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []runEvent
+	for i := len(r.events); i > 0 && r.events[i-1].id > id; i-- {
+		out = r.events[i-1:]
+	}
+	return append([]runEvent(nil), out...), r.done, r.changed
+}
+
+func (r *run) attach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watchers++
+	if r.orphaned != nil {
+		r.orphaned.Stop()
+		r.orphaned = nil
+	}
+}
+
+// detach lets the run go on for the grace period once its last watcher has
+// left, then cancels it.
+func (r *run) detach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watchers--
+	if r.watchers > 0 || r.done || r.background {
+		return
+	}
+	r.orphaned = time.AfterFunc(r.grace, func() { r.cancel(nil) })
+}
+
+// stop cancels the run with cause, or returns false if it has already
+// finished.
+func (r *run) stop(cause error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done {
+		return false
+	}
+	r.cancel(cause)
+	return true
+}
+
+// wait blocks until the run has finished and returns its last event.
+func (r *run) wait(ctx context.Context) (service.StatusEvent, error) {
+	for {
+		r.mu.Lock()
+		done, changed := r.done, r.changed
+		var last service.StatusEvent
+		if n := len(r.events); n > 0 {
+			last = r.events[n-1].event
+		}
+		r.mu.Unlock()
+		if done {
+			return last, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return service.StatusEvent{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+var (
+	errRunning = errors.New("already being processed")
+	// errShuttingDown cancels the runs still going at shutdown, so they are
+	// recorded as cancelled
+	errShuttingDown = fmt.Errorf("server is shutting down: %w", service.ErrCancelled)
+)
+
+// runs tracks the runs by message ID. A finished run stays for the grace
+// period so a client that lost the end of the stream can still replay it.
+type runs struct {
+	grace time.Duration
+
+	mu       sync.Mutex
+	byID     map[string]*run
+	draining bool
+	// active counts the runs that haven't finished
+	active sync.WaitGroup
+}
+
+func newRuns(grace time.Duration) *runs {
+	return &runs{grace: grace, byID: make(map[string]*run)}
+}
+
+// start registers a run for messageID, replacing one that has failed. It
+// fails with errRunning if one is still running or has completed, and
+// errShuttingDown once the runs are being drained. Cancelling the run
+// cancels the pipeline's context with a cause.
+func (rs *runs) start(messageID, hash string, cancel context.CancelCauseFunc, background bool) (*run, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.draining {
+		return nil, errShuttingDown
+	}
+	if old, ok := rs.byID[messageID]; ok && !old.failed() {
+		return nil, errRunning
+	}
+	r := &run{
+		messageID:  messageID,
+		hash:       hash,
+		cancel:     cancel,
+		background: background,
+		grace:      rs.grace,
+		changed:    make(chan struct{}),
+	}
+	rs.byID[messageID] = r
+	rs.active.Add(1)
+	return r, nil
+}
+
+func (rs *runs) get(messageID string) (*run, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.byID[messageID]
+	return r, ok
+}
+
+// finish marks r done and forgets it after the grace period.
+func (rs *runs) finish(r *run) {
+	r.finish()
+	rs.active.Done()
+	time.AfterFunc(rs.grace, func() {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		if rs.byID[r.messageID] == r {
+			delete(rs.byID, r.messageID)
+		}
+	})
+}
+
+// discard forgets r at once, for a run that never started.
+func (rs *runs) discard(r *run) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.byID[r.messageID] == r {
+		delete(rs.byID, r.messageID)
+	}
+	rs.active.Done()
+}
+
+// drain refuses new runs, cancels those still going with errShuttingDown
+// and waits for them to finish or ctx to be done.
+func (rs *runs) drain(ctx context.Context) error {
+	rs.mu.Lock()
+	rs.draining = true
+	for _, r := range rs.byID {
+		r.stop(errShuttingDown)
+	}
+	rs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		rs.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("runs still going: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,139 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/server"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDrain(t *testing.T) {
+	srv, h := newServer(t, &stubLLM{gate: make(chan struct{})})
+
+	stream := post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-1"})
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+	created := post(t, srv, "/api/jobs", map[string]string{"message": "q"})
+	require.Equal(t, http.StatusAccepted, created.StatusCode)
+	var job struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.NewDecoder(created.Body).Decode(&job))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, h.Drain(ctx))
+
+	// Both were cancelled and have ended by the time Drain returns
+	require.Equal(t, service.StatusCancelled, last(readEvents(t, stream.Body)).Status)
+	var view struct {
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.NewDecoder(get(t, srv, "/api/jobs/"+job.ID).Body).Decode(&view))
+	require.Equal(t, "cancelled", view.Status)
+
+	refused := post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-2"})
+	require.Equal(t, http.StatusServiceUnavailable, refused.StatusCode)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s := server.NewServer("127.0.0.1:0", http.NotFoundHandler(), zap.NewNop())
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+
+	// Run may not have started listening yet, so shut down until it returns
+	require.Eventually(t, func() bool {
+		require.NoError(t, s.Shutdown(context.Background()))
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			return true
+		default:
+			return false
+		}
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestResumeMessage_Replay(t *testing.T) {
+	srv, _ := newServer(t, &stubLLM{tokens: 10})
+	all := readEvents(t, post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-1"}).Body)
+	require.Equal(t, service.StatusCompleted, last(all).Status)
+	for i, e := range all {
+		require.Equal(t, i+1, e.id)
+	}
+
+	t.Run("mid-buffer", func(t *testing.T) {
+		mid := len(all) / 2
+		res := get(t, srv, "/api/process/msg-1", "Last-Event-ID", strconv.Itoa(mid))
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, all[mid:], readEvents(t, res.Body))
+	})
+
+	t.Run("query parameter", func(t *testing.T) {
+		res := get(t, srv, "/api/process/msg-1?last_event_id="+strconv.Itoa(len(all)-1))
+		require.Equal(t, all[len(all)-1:], readEvents(t, res.Body))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, get(t, srv, "/api/process/msg-1", "Last-Event-ID", "-1").StatusCode)
+	})
+}
+
+func TestResumeMessage_OlderThanBuffer(t *testing.T) {
+	// Enough tokens for the buffer to drop the oldest events
+	srv, _ := newServer(t, &stubLLM{tokens: 3000})
+	all := readEvents(t, post(t, srv, "/api/process", map[string]string{"message": "q", "message_id": "msg-1"}).Body)
+	lastID := all[len(all)-1].id
+	require.Greater(t, lastID, 2048)
+
+	replayed := readEvents(t, get(t, srv, "/api/process/msg-1", "Last-Event-ID", "1").Body)
+	// The client misses the dropped events but gets the rest, up to the end
+	require.Greater(t, replayed[0].id, 2)
+	require.GreaterOrEqual(t, len(replayed), 1024)
+	for i, e := range replayed {
+		require.Equal(t, replayed[0].id+i, e.id)
+	}
+	require.Equal(t, lastID, replayed[len(replayed)-1].id)
+	require.Equal(t, service.StatusCompleted, last(replayed).Status)
+}
+
+func TestResumeMessage_GraceExpiry(t *testing.T) {
+	stub := &stubLLM{gate: make(chan struct{})}
+	srv, _ := newServer(t, stub, server.WithDisconnectGrace(50*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/process",
+		strings.NewReader(`{"message": "q", "message_id": "msg-1"}`))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	for range sseEvents(t, res.Body) {
+		break
+	}
+	// The client goes away and doesn't come back
+	cancel()
+	res.Body.Close()
+
+	// Reconnecting would keep it going, so watch the agents instead
+	require.Eventually(t, func() bool {
+		calls, cancelled := stub.counts()
+		return calls == 2 && cancelled == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	events := readEvents(t, get(t, srv, "/api/process/msg-1").Body)
+	require.Equal(t, service.Status("error"), last(events).Status)
+	require.Equal(t, string(llm.ErrorClassCancelled), last(events).ErrorClass)
+
+	// A finished run can be replayed for the grace period, then it's gone
+	require.Eventually(t, func() bool {
+		return get(t, srv, "/api/process/msg-1").StatusCode == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+}
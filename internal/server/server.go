@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
@@ -28,7 +29,12 @@ func NewServer(addr string, handler http.Handler, logger *zap.Logger) *Server {
 
 func (s *Server) Run() error {
 	s.logger.Info("HTTP server is starting", zap.String("addr", s.httpServer.Addr))
-	return s.httpServer.ListenAndServe()
+	// Shutdown makes it return at once; the caller's Shutdown is what
+	// finishes, so closing isn't an error here
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
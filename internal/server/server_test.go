@@ -0,0 +1,258 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/server"
+	"llmsse/internal/service"
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// stubLLM answers every agent after delay and streams tokens tokens as the
+// combined answer. Agents asked a message containing "fail" fail, and while
+// gate is open every call waits for it to close.
+type stubLLM struct {
+	tokens int
+	gate   chan struct{}
+	delay  time.Duration
+
+	mu        sync.Mutex
+	calls     int
+	cancelled int
+	// inFlight counts the agent calls running, peak the most at once
+	inFlight, peak int
+}
+
+func (s *stubLLM) wait(ctx context.Context) error {
+	if s.gate == nil {
+		return nil
+	}
+	select {
+	case <-s.gate:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.cancelled++
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *stubLLM) Call(ctx context.Context, messages []llm.ChatMessage, _ ...llm.Option) (llm.Completion, error) {
+	s.mu.Lock()
+	s.calls++
+	s.inFlight++
+	s.peak = max(s.peak, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(s.delay)
+	if err := s.wait(ctx); err != nil {
+		return llm.Completion{}, err
+	}
+	if strings.Contains(messages[len(messages)-1].Content, "fail") {
+		return llm.Completion{}, errors.New("agent failed")
+	}
+	return llm.Completion{Content: "answer", Usage: &llm.Usage{TotalTokens: 1}}, nil
+}
+
+func (s *stubLLM) Stream(ctx context.Context, _ []llm.ChatMessage, _ ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	return func(yield func(llm.Chunk, error) bool) {
+		if err := s.wait(ctx); err != nil {
+			yield(llm.Chunk{}, err)
+			return
+		}
+		for i := range max(s.tokens, 1) {
+			if !yield(llm.Chunk{Content: "tok" + strconv.Itoa(i) + " "}, nil) {
+				return
+			}
+		}
+		yield(llm.Chunk{Usage: &llm.Usage{TotalTokens: 2}}, nil)
+	}
+}
+
+func (s *stubLLM) counts() (calls, cancelled int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls, s.cancelled
+}
+
+// newServer serves a router over stub, drained when the test ends.
+func newServer(t *testing.T, stub llm.Interface, opts ...server.RouterOption) (*httptest.Server, *server.Handler) {
+	t.Helper()
+	return serve(t, service.NewService(stub, zap.NewNop()), opts...)
+}
+
+// newStoreServer is newServer recording messages in a store.
+func newStoreServer(t *testing.T, stub llm.Interface, opts ...server.RouterOption) *httptest.Server {
+	t.Helper()
+	st := store.NewMemory(0)
+	srv, _ := serve(t, service.NewService(stub, zap.NewNop(), service.WithStore(st)), append(opts, server.WithStore(st))...)
+	return srv
+}
+
+func serve(t *testing.T, svc *service.Service, opts ...server.RouterOption) (*httptest.Server, *server.Handler) {
+	router, h := server.NewRouter(svc, zap.NewNop(), append([]server.RouterOption{server.WithRateLimit(rate.Inf, 0)}, opts...)...)
+	srv := httptest.NewServer(router)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, h.Drain(ctx))
+		srv.Close()
+	})
+	return srv, h
+}
+
+type sseEvent struct {
+	id    int
+	event service.StatusEvent
+}
+
+// readEvents reads SSE frames until the stream ends.
+func readEvents(t *testing.T, body io.Reader) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for next := range sseEvents(t, body) {
+		events = append(events, next)
+	}
+	return events
+}
+
+func sseEvents(t *testing.T, body io.Reader) iter.Seq[sseEvent] {
+	return func(yield func(sseEvent) bool) {
+		sc := bufio.NewScanner(body)
+		sc.Buffer(nil, 1<<20)
+		var e sseEvent
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id, err := strconv.Atoi(strings.TrimPrefix(line, "id: "))
+				require.NoError(t, err)
+				e.id = id
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.event))
+				if !yield(e) {
+					return
+				}
+				e = sseEvent{}
+			}
+		}
+	}
+}
+
+func post(t *testing.T, srv *httptest.Server, path string, body any, header ...string) *http.Response {
+	t.Helper()
+	b, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader(b))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func get(t *testing.T, srv *httptest.Server, path string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func last(events []sseEvent) service.StatusEvent {
+	return events[len(events)-1].event
+}
+
+type jobView struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+	Answer    string `json:"answer"`
+	Usage     *struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+func createJob(t *testing.T, srv *httptest.Server, body any) (*http.Response, jobView) {
+	t.Helper()
+	res := post(t, srv, "/api/jobs", body)
+	var j jobView
+	if res.StatusCode == http.StatusAccepted {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&j))
+	}
+	return res, j
+}
+
+// pollJob polls a job until it has finished.
+func pollJob(t *testing.T, srv *httptest.Server, id string) jobView {
+	t.Helper()
+	var j jobView
+	require.Eventually(t, func() bool {
+		res := get(t, srv, "/api/jobs/"+id)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&j))
+		return j.Status != "running"
+	}, 2*time.Second, 10*time.Millisecond)
+	return j
+}
+
+type batchLine struct {
+	Line      int    `json:"line"`
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+	Answer    string `json:"answer"`
+	Usage     *struct {
+		TotalTokens int `json:"total_tokens"`
+	} `json:"usage"`
+	Error      string `json:"error"`
+	ErrorClass string `json:"error_class"`
+}
+
+func postBatch(t *testing.T, srv *httptest.Server, lines ...string) []batchLine {
+	t.Helper()
+	res, err := http.Post(srv.URL+"/api/batch", "application/x-ndjson", strings.NewReader(strings.Join(lines, "\n")))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	var out []batchLine
+	for sc := bufio.NewScanner(res.Body); sc.Scan(); {
+		var l batchLine
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &l))
+		out = append(out, l)
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"llmsse/internal/server"
+	"llmsse/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestWebhook_SanitizedError(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies <- b
+	}))
+	t.Cleanup(receiver.Close)
+	// The receiver listens on loopback, which the default client refuses
+	sender := webhook.New("secret", zap.NewNop(), webhook.WithClient(http.DefaultClient))
+	t.Cleanup(sender.Close)
+	srv, _ := newServer(t, &stubLLM{}, server.WithWebhooks(sender))
+
+	res := post(t, srv, "/api/process", map[string]string{"message": "please fail", "message_id": "msg-1", "webhook_url": receiver.URL})
+	readEvents(t, res.Body)
+
+	body := <-bodies
+	var p webhook.Payload
+	require.NoError(t, json.Unmarshal(body, &p))
+	require.Equal(t, webhook.EventFailed, p.Event)
+	require.Equal(t, "processing failed", p.Error)
+	require.Equal(t, "unknown", p.ErrorClass)
+	require.NotContains(t, string(body), "agent failed", "the raw error stays in the logs")
+}
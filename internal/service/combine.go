@@ -0,0 +1,336 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+)
+
+// Combiner produces the final answer of a pipeline from the results of the
+// final stage's dependencies.
+type Combiner interface {
+	Name() string
+	Combine(ctx context.Context, c *Combination) error
+}
+
+const (
+	CombineSynthesis = "synthesis"
+	CombineConcat    = "concat"
+	CombineJudge     = "judge"
+	CombineRanked    = "ranked"
+)
+
+var combiners = map[string]Combiner{
+	CombineSynthesis: synthesisCombiner{},
+	CombineConcat:    concatCombiner{},
+	CombineJudge:     judgeCombiner{},
+	CombineRanked:    rankedCombiner{},
+}
+
+// ParseCombiner returns the built-in strategy called name.
+func ParseCombiner(name string) (Combiner, error) {
+	c, ok := combiners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown combine strategy %q", name)
+	}
+	return c, nil
+}
+
+// Combination is the input of a Combiner and the way it answers: through
+// Stream for an LLM-written answer or Answer for text it already has.
+type Combination struct {
+	Message string
+	// Results are in dependency, then task, declaration order; failed and
+	// skipped agents are included with Err set.
+	Results []LLMResult
+
+	s      *Service
+	r      *run
+	stage  *Stage
+	usage  llm.Usage
+	answer LLMResult
+}
+
+// Succeeded returns the results that have an answer.
+func (c *Combination) Succeeded() []LLMResult {
+	var out []LLMResult
+	for _, res := range c.Results {
+		if res.Err == nil {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// Call runs a helper task, such as a judge, without streaming its answer.
+func (c *Combination) Call(ctx context.Context, task PromptTask) (LLMResult, error) {
+	if !c.r.emit(ctx, StatusEvent{
+		Status:   Status("Sending to " + task.ID),
+		Source:   task.ID,
+		Template: task.Template,
+		Stage:    c.stage.ID,
+	}) {
+		return LLMResult{}, ctx.Err()
+	}
+	res, err := c.s.callTask(ctx, task)
+	if err != nil {
+		return LLMResult{}, fmt.Errorf("%s failed: %w", task.ID, err)
+	}
+	c.usage.Add(res.Usage)
+	return res, nil
+}
+
+// Render renders the request's template id with inputs as its Inputs and
+// returns the text along with the template's id@version.
+func (c *Combination) Render(id, inputs string) (string, string, error) {
+	t, err := c.r.prompts.Get(id)
+	if err != nil {
+		return "", "", err
+	}
+	text, err := t.Render(prompt.Data{
+		Message: c.Message,
+		History: c.r.opts.History,
+		Locale:  c.r.opts.Locale,
+		Inputs:  inputs,
+	})
+	return text, t.Ref(), err
+}
+
+// Messages builds a prompt of system, the conversation's earlier turns and
+// user.
+func (c *Combination) Messages(system, user string) []llm.ChatMessage {
+	return chatMessages(system, c.r.opts.History, user)
+}
+
+// Stream streams task's answer to the client as the final answer.
+func (c *Combination) Stream(ctx context.Context, task PromptTask) error {
+	res, err := c.s.streamFinal(ctx, c.r, c.stage, task)
+	if err != nil {
+		return err
+	}
+	c.usage.Add(res.Usage)
+	c.answer = res
+	return nil
+}
+
+// Answer sends text attributed to source as the final answer.
+func (c *Combination) Answer(ctx context.Context, source, text string) error {
+	return c.answerWith(ctx, LLMResult{ID: source, Message: text})
+}
+
+func (c *Combination) answerWith(ctx context.Context, res LLMResult) error {
+	if !c.r.emit(ctx, StatusEvent{
+		Status:   StatusStreaming,
+		Source:   res.ID,
+		Template: res.Template,
+		Stage:    c.stage.ID,
+		Message:  res.Message,
+	}) {
+		return ctx.Err()
+	}
+	c.answer = LLMResult{ID: res.ID, Template: res.Template, Message: res.Message}
+	return nil
+}
+
+func (c *Combination) result() LLMResult {
+	res := c.answer
+	res.Usage = &c.usage
+	return res
+}
+
+// labeled renders the answers among results as sections headed by the
+// agent that wrote them.
+func labeled(results []LLMResult) string {
+	var sections []string
+	for _, res := range results {
+		if res.Err == nil {
+			sections = append(sections, fmt.Sprintf("### %s\n%s", res.ID, strings.TrimSpace(res.Message)))
+		}
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// missing returns the agents among results without an answer, whether they
+// failed, timed out or were stopped once the policy was met.
+func missing(results []LLMResult) []string {
+	var ids []string
+	for _, res := range results {
+		if res.Err != nil {
+			ids = append(ids, res.ID)
+		}
+	}
+	return ids
+}
+
+// promptInputs is labeled for an LLM's prompt, led by a note that asks it to
+// say which perspectives are missing.
+func promptInputs(results []LLMResult) string {
+	ids := missing(results)
+	if len(ids) == 0 {
+		return labeled(results)
+	}
+	return fmt.Sprintf("Note: the perspectives of %s are missing because those agents did not answer. "+
+		"State in your answer that these perspectives are not represented.\n\n%s",
+		strings.Join(ids, ", "), labeled(results))
+}
+
+// synthesisCombiner has an LLM write one answer from every response.
+type synthesisCombiner struct{}
+
+func (synthesisCombiner) Name() string { return CombineSynthesis }
+
+func (synthesisCombiner) Combine(ctx context.Context, c *Combination) error {
+	inputs := promptInputs(c.Results)
+	system, ref, err := c.Render(prompt.CombineSynthesis, inputs)
+	if err != nil {
+		return err
+	}
+	return c.Stream(ctx, PromptTask{
+		ID:       "llm-combine",
+		Template: ref,
+		Prompt:   c.Messages(system, inputs),
+	})
+}
+
+// concatCombiner returns every answer as is, without another LLM call.
+type concatCombiner struct{}
+
+func (concatCombiner) Name() string { return CombineConcat }
+
+func (concatCombiner) Combine(ctx context.Context, c *Combination) error {
+	text := labeled(c.Results)
+	if ids := missing(c.Results); len(ids) > 0 {
+		text = fmt.Sprintf("Note: no answer from %s.\n\n%s", strings.Join(ids, ", "), text)
+	}
+	return c.Answer(ctx, c.stage.ID, text)
+}
+
+// judgeCombiner has an LLM pick the best answer and returns it verbatim.
+type judgeCombiner struct{}
+
+func (judgeCombiner) Name() string { return CombineJudge }
+
+func (judgeCombiner) Combine(ctx context.Context, c *Combination) error {
+	succeeded := c.Succeeded()
+	switch len(succeeded) {
+	case 0:
+		return errors.New("judge: no answers to choose from")
+	case 1:
+		return c.answerWith(ctx, succeeded[0])
+	}
+
+	var verdict struct {
+		Best   string `json:"best"`
+		Reason string `json:"reason"`
+	}
+	schema, err := choiceSchema("verdict", succeeded, `{"best": %s, "reason": {"type": "string"}}`, `["best", "reason"]`)
+	if err != nil {
+		return err
+	}
+	system, ref, err := c.Render(prompt.CombineJudge, labeled(succeeded))
+	if err != nil {
+		return err
+	}
+	res, err := c.Call(ctx, PromptTask{
+		ID:       "llm-judge",
+		Template: ref,
+		Schema:   schema,
+		Prompt:   c.Messages(system, fmt.Sprintf("Question:\n%s\n\nResponses:\n\n%s", c.Message, labeled(succeeded))),
+	})
+	if err != nil {
+		return err
+	}
+	if err := res.Decode(&verdict); err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(succeeded, func(r LLMResult) bool { return r.ID == verdict.Best })
+	if i < 0 {
+		return fmt.Errorf("judge chose unknown answer %q", verdict.Best)
+	}
+	return c.answerWith(ctx, succeeded[i])
+}
+
+// rankedCombiner has an LLM rank the answers, then merges them best first,
+// preferring higher-ranked answers where they conflict.
+type rankedCombiner struct{}
+
+func (rankedCombiner) Name() string { return CombineRanked }
+
+func (rankedCombiner) Combine(ctx context.Context, c *Combination) error {
+	ranked := c.Succeeded()
+	if len(ranked) > 1 {
+		var ranking struct {
+			Ranking []string `json:"ranking"`
+		}
+		schema, err := choiceSchema("ranking", ranked, `{"ranking": {"type": "array", "items": %s}}`, `["ranking"]`)
+		if err != nil {
+			return err
+		}
+		system, ref, err := c.Render(prompt.CombineRank, labeled(ranked))
+		if err != nil {
+			return err
+		}
+		res, err := c.Call(ctx, PromptTask{
+			ID:       "llm-ranker",
+			Template: ref,
+			Schema:   schema,
+			Prompt:   c.Messages(system, fmt.Sprintf("Question:\n%s\n\nResponses:\n\n%s", c.Message, labeled(ranked))),
+		})
+		if err != nil {
+			return err
+		}
+		if err := res.Decode(&ranking); err != nil {
+			return err
+		}
+
+		// Labels the ranker left out keep their declaration order at the end
+		rank := func(id string) int {
+			if i := slices.Index(ranking.Ranking, id); i >= 0 {
+				return i
+			}
+			return len(ranking.Ranking)
+		}
+		slices.SortStableFunc(ranked, func(a, b LLMResult) int { return rank(a.ID) - rank(b.ID) })
+	}
+
+	var failed []LLMResult
+	for _, res := range c.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	inputs := promptInputs(append(ranked, failed...))
+	system, ref, err := c.Render(prompt.CombineRanked, inputs)
+	if err != nil {
+		return err
+	}
+	return c.Stream(ctx, PromptTask{
+		ID:       "llm-combine",
+		Template: ref,
+		Prompt:   c.Messages(system, inputs),
+	})
+}
+
+// choiceSchema builds a schema whose choice slots only accept the labels of
+// results. properties is a JSON object template with one %s for the choice.
+func choiceSchema(name string, results []LLMResult, properties, required string) (*llm.Schema, error) {
+	ids := make([]string, len(results))
+	for i, res := range results {
+		ids[i] = res.ID
+	}
+	enum, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	choice := fmt.Sprintf(`{"type": "string", "enum": %s}`, enum)
+	raw := fmt.Sprintf(`{"type": "object", "properties": %s, "required": %s, "additionalProperties": false}`,
+		fmt.Sprintf(properties, choice), required)
+	return llm.ParseSchema(name, []byte(raw))
+}
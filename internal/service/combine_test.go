@@ -0,0 +1,148 @@
+package service_test
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// judgeLLM answers agents by system prompt, prefers llm-2 (or best) when
+// asked to judge or rank, and records what it was asked to stream.
+type judgeLLM struct {
+	best     string
+	mu       sync.Mutex
+	streamed []llm.ChatMessage
+}
+
+func (j *judgeLLM) Call(_ context.Context, messages []llm.ChatMessage, opts ...llm.Option) (llm.Completion, error) {
+	var o llm.CallOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.ResponseFormat != nil && o.ResponseFormat.JSONSchema != nil {
+		switch o.ResponseFormat.JSONSchema.Name {
+		case "verdict":
+			return llm.Completion{Content: fmt.Sprintf(`{"best": %q, "reason": "more complete"}`, cmp.Or(j.best, "llm-2"))}, nil
+		case "ranking":
+			return llm.Completion{Content: `{"ranking": ["llm-2", "llm-1"]}`}, nil
+		}
+	}
+	return llm.Completion{Content: "answer from " + messages[0].Content}, nil
+}
+
+func (j *judgeLLM) Stream(_ context.Context, messages []llm.ChatMessage, _ ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	j.mu.Lock()
+	j.streamed = messages
+	j.mu.Unlock()
+	return func(yield func(llm.Chunk, error) bool) {
+		yield(llm.Chunk{Content: "merged"}, nil)
+	}
+}
+
+func TestProcessMessage_Combiners(t *testing.T) {
+	run := func(t *testing.T, strategy string) (string, *judgeLLM) {
+		stub := &judgeLLM{}
+		svc := service.NewService(stub, zap.NewNop())
+		combiner, err := service.ParseCombiner(strategy)
+		require.NoError(t, err)
+
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err = svc.ProcessMessage(context.Background(), "msg-1", "", agentTasks(2), eventChan, service.WithCombiner(combiner))
+		events := wait()
+		require.NoError(t, err)
+
+		var answer string
+		for _, e := range events {
+			if e.Status == service.StatusStreaming {
+				answer += e.Message
+			}
+		}
+		return answer, stub
+	}
+
+	t.Run("synthesis labels answers in task order", func(t *testing.T) {
+		answer, stub := run(t, service.CombineSynthesis)
+		require.Equal(t, "merged", answer)
+		require.Equal(t, "### llm-1\nanswer from agent 1\n\n### llm-2\nanswer from agent 2", stub.streamed[1].Content)
+	})
+
+	t.Run("concat needs no LLM", func(t *testing.T) {
+		answer, stub := run(t, service.CombineConcat)
+		require.Equal(t, "### llm-1\nanswer from agent 1\n\n### llm-2\nanswer from agent 2", answer)
+		require.Nil(t, stub.streamed)
+	})
+
+	t.Run("concat names missing agents without instructions", func(t *testing.T) {
+		concat, err := service.ParseCombiner(service.CombineConcat)
+		require.NoError(t, err)
+		svc := service.NewService(&stubLLM{replies: map[string]error{"agent 2": errors.New("boom")}}, zap.NewNop())
+
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err = svc.ProcessMessage(context.Background(), "msg-1", "", agentTasks(2), eventChan,
+			service.WithCombiner(concat),
+			service.WithPolicy(service.CompletionPolicy{Mode: service.PolicyBestEffort, Min: 1}))
+		events := wait()
+		require.NoError(t, err)
+
+		var answer string
+		for _, e := range events {
+			if e.Status == service.StatusStreaming {
+				answer += e.Message
+			}
+		}
+		require.Equal(t, "Note: no answer from llm-2.\n\n### llm-1\nanswer from agent 1", answer)
+	})
+
+	t.Run("judge returns the chosen answer", func(t *testing.T) {
+		answer, _ := run(t, service.CombineJudge)
+		require.Equal(t, "answer from agent 2", answer)
+	})
+
+	t.Run("ranked merges best first", func(t *testing.T) {
+		answer, stub := run(t, service.CombineRanked)
+		require.Equal(t, "merged", answer)
+		require.Equal(t, "### llm-2\nanswer from agent 2\n\n### llm-1\nanswer from agent 1", stub.streamed[1].Content)
+	})
+}
+
+func TestJudgeCombiner_NoValidChoice(t *testing.T) {
+	judge, err := service.ParseCombiner(service.CombineJudge)
+	require.NoError(t, err)
+	run := func(stub *judgeLLM, p *service.Pipeline) error {
+		svc := service.NewService(stub, zap.NewNop())
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err := svc.RunPipeline(context.Background(), "msg-1", "", "q", p, eventChan)
+		wait()
+		return err
+	}
+
+	t.Run("no answers", func(t *testing.T) {
+		p := &service.Pipeline{
+			Name: "skipped",
+			Stages: []service.Stage{
+				{ID: "agents", Tasks: service.StaticTasks(agentTasks(2)...), When: func(service.StageInput) bool { return false }},
+				service.CombineStage("combine", judge, "agents"),
+			},
+		}
+		require.ErrorContains(t, run(&judgeLLM{}, p), "no answers to choose from")
+	})
+
+	t.Run("unknown choice", func(t *testing.T) {
+		p := service.FanOutPipeline("fan-out", agentTasks(2))
+		p.Stages[len(p.Stages)-1].Combine = judge
+		require.ErrorContains(t, run(&judgeLLM{best: "llm-9"}, p), "best")
+	})
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StatusDebateRound     Status = "Debate round"
+	StatusDebateConverged Status = "Debate converged"
+)
+
+// Debate makes a stage's agents revise their answers over several rounds,
+// each round showing every agent the others' latest answers.
+type Debate struct {
+	// Rounds is the maximum number of rounds, the first included.
+	Rounds int
+	// Converge ends the debate early once every pair of answers is at least
+	// this similar, measured as word overlap from 0 to 1. Zero runs every round.
+	Converge float64
+}
+
+func (s *Service) runDebate(ctx context.Context, r *run, st *Stage, tasks []PromptTask) (StageOutput, error) {
+	rounds := max(st.Debate.Rounds, 1)
+	policy := s.stagePolicy(r, st)
+	usage := &llm.Usage{}
+	revise, err := r.prompts.Get(prompt.DebateRevise)
+	if err != nil {
+		return StageOutput{}, err
+	}
+
+	var results []LLMResult
+	current := tasks
+	for round := 1; round <= rounds; round++ {
+		rr := r.inRound(round)
+		if !rr.emit(ctx, StatusEvent{
+			Status:  StatusDebateRound,
+			Source:  st.ID,
+			Stage:   st.ID,
+			Message: fmt.Sprintf("round %d of %d", round, rounds),
+		}) {
+			return StageOutput{}, ctx.Err()
+		}
+
+		latest, err := s.runTasksInParallel(ctx, rr, st.ID, current, policy)
+		if err != nil {
+			return StageOutput{}, fmt.Errorf("round %d: %w", round, err)
+		}
+		for _, res := range latest {
+			usage.Add(res.Usage)
+		}
+		results = keepAnswered(results, latest)
+
+		if round == rounds {
+			break
+		}
+		if similarity, ok := converged(results, st.Debate.Converge); ok {
+			s.logger.Debug("Debate converged", r.logFields(
+				zap.String("stage", st.ID),
+				zap.Int("round", round),
+				zap.Float64("similarity", similarity),
+			)...)
+			if !rr.emit(ctx, StatusEvent{
+				Status:  StatusDebateConverged,
+				Source:  st.ID,
+				Stage:   st.ID,
+				Message: fmt.Sprintf("answers agree at %.2f similarity after round %d", similarity, round),
+			}) {
+				return StageOutput{}, ctx.Err()
+			}
+			break
+		}
+		current, err = reviseTasks(revise, r, tasks, results)
+		if err != nil {
+			return StageOutput{}, err
+		}
+	}
+
+	return stageOutput(st.ID, results, usage), nil
+}
+
+// keepAnswered takes the latest round's results, except that an agent that
+// failed this round keeps its previous answer.
+func keepAnswered(previous, latest []LLMResult) []LLMResult {
+	if previous == nil {
+		return latest
+	}
+	out := make([]LLMResult, len(latest))
+	for i, res := range latest {
+		if res.Err != nil && previous[i].Err == nil {
+			res = previous[i]
+		}
+		out[i] = res
+	}
+	return out
+}
+
+// reviseTasks continues each agent's conversation with its own last answer
+// and asks it, through the revise template, to reconsider in light of its
+// peers' answers.
+func reviseTasks(revise *prompt.Template, r *run, tasks []PromptTask, results []LLMResult) ([]PromptTask, error) {
+	revised := make([]PromptTask, len(tasks))
+	for i, task := range tasks {
+		var peers []LLMResult
+		for j, res := range results {
+			if j != i && res.Err == nil {
+				peers = append(peers, res)
+			}
+		}
+
+		messages := append([]llm.ChatMessage(nil), task.Prompt...)
+		if results[i].Err == nil {
+			messages = append(messages, llm.ChatMessage{Role: "assistant", Content: results[i].Message})
+		}
+		if len(peers) > 0 {
+			text, err := revise.Render(prompt.Data{
+				History: r.opts.History,
+				Locale:  r.opts.Locale,
+				Inputs:  labeled(peers),
+			})
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, llm.ChatMessage{Role: "user", Content: text})
+			task.Template = joinRefs(task.Template, revise.Ref())
+		}
+
+		task.Prompt = messages
+		revised[i] = task
+	}
+	return revised, nil
+}
+
+// converged reports the lowest pairwise similarity of the answers and whether
+// it reaches threshold.
+func converged(results []LLMResult, threshold float64) (float64, bool) {
+	if threshold <= 0 {
+		return 0, false
+	}
+
+	var answers []map[string]bool
+	for _, res := range results {
+		if res.Err == nil {
+			answers = append(answers, wordSet(res.Message))
+		}
+	}
+
+	lowest := 1.0
+	for i := range answers {
+		for j := i + 1; j < len(answers); j++ {
+			lowest = min(lowest, jaccard(answers[i], answers[j]))
+		}
+	}
+	return lowest, lowest >= threshold
+}
+
+func wordSet(text string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		set[w] = true
+	}
+	return set
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	shared := 0
+	for w := range a {
+		if b[w] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,88 @@
+package service_test
+
+import (
+	"context"
+	"iter"
+	"strings"
+	"sync"
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// debateLLM disagrees in the first round and agrees once it has seen its
+// peers, recording every revision prompt.
+type debateLLM struct {
+	mu        sync.Mutex
+	revisions []string
+}
+
+func (d *debateLLM) Call(_ context.Context, messages []llm.ChatMessage, _ ...llm.Option) (llm.Completion, error) {
+	if len(messages) == 2 {
+		return llm.Completion{Content: "first thoughts of " + messages[0].Content}, nil
+	}
+	d.mu.Lock()
+	d.revisions = append(d.revisions, messages[len(messages)-1].Content)
+	d.mu.Unlock()
+	return llm.Completion{Content: "we agree"}, nil
+}
+
+func (d *debateLLM) Stream(context.Context, []llm.ChatMessage, ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	return func(yield func(llm.Chunk, error) bool) {
+		yield(llm.Chunk{Content: "combined"}, nil)
+	}
+}
+
+func TestRunPipeline_DebateConverges(t *testing.T) {
+	stub := &debateLLM{}
+	svc := service.NewService(stub, zap.NewNop())
+	concat, err := service.ParseCombiner(service.CombineConcat)
+	require.NoError(t, err)
+
+	p := &service.Pipeline{
+		Name: "debate",
+		Stages: []service.Stage{
+			{
+				ID:     "debate",
+				Tasks:  service.StaticTasks(agentTasks(2)...),
+				Debate: &service.Debate{Rounds: 5, Converge: 0.9},
+			},
+			service.CombineStage("combine", concat, "debate"),
+		},
+	}
+
+	eventChan := make(chan service.StatusEvent, 64)
+	wait := collectEvents(eventChan)
+	err = svc.RunPipeline(context.Background(), "msg-1", "", "q", p, eventChan)
+	events := wait()
+	require.NoError(t, err)
+
+	var rounds []int
+	var convergedRound int
+	var answer string
+	for _, e := range events {
+		switch {
+		case e.Status == service.StatusDebateRound:
+			rounds = append(rounds, e.Round)
+		case e.Status == service.StatusDebateConverged:
+			convergedRound = e.Round
+		case e.Status == "Sending to llm-1":
+			require.NotZero(t, e.Round)
+		case e.Status == service.StatusStreaming:
+			answer += e.Message
+		}
+	}
+	require.Equal(t, []int{1, 2}, rounds)
+	require.Equal(t, 2, convergedRound)
+	require.Equal(t, "### llm-1\nwe agree\n\n### llm-2\nwe agree", answer)
+
+	require.Len(t, stub.revisions, 2)
+	for _, revision := range stub.revisions {
+		require.True(t, strings.Contains(revision, "first thoughts of agent 1") != strings.Contains(revision, "first thoughts of agent 2"),
+			"each agent should see only its peer's answer: %q", revision)
+	}
+}
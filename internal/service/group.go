@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// group runs goroutines under a shared cancellable context, errgroup style:
+// Stop cancels whatever is still running and waits for every goroutine to
+// return, so no work outlives the call that started it.
+type group struct {
+	cancel context.CancelCauseFunc
+	wg     sync.WaitGroup
+}
+
+func newGroup(ctx context.Context) (*group, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &group{cancel: cancel}, ctx
+}
+
+func (g *group) Go(fn func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+	}()
+}
+
+// Stop cancels the group's context with cause and waits for all goroutines.
+// It is safe to call more than once.
+func (g *group) Stop(cause error) {
+	g.cancel(cause)
+	g.wg.Wait()
+}
+
+// emit delivers an event unless ctx ends first, so producers never block on a
+// reader that has gone away.
+func emit(ctx context.Context, stream chan<- StatusEvent, event StatusEvent) bool {
+	select {
+	case stream <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
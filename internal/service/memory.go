@@ -0,0 +1,24 @@
+package service
+
+import (
+	"context"
+
+	"llmsse/internal/prompt"
+
+	"go.uber.org/zap"
+)
+
+// history loads the window of earlier turns of the request's conversation
+// from the store. A conversation that can't be loaded is answered without
+// its history.
+func (s *Service) history(ctx context.Context, r *run) []prompt.Turn {
+	if s.store == nil || r.conversationID == "" || s.historyTurns <= 0 {
+		return nil
+	}
+	turns, err := s.store.History(ctx, r.conversationID, s.historyTurns)
+	if err != nil {
+		s.logger.Warn("Failed to load conversation history", r.logFields(zap.Error(err))...)
+		return nil
+	}
+	return turns
+}
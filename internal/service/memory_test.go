@@ -0,0 +1,53 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/service"
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRunPipeline_ConversationMemory(t *testing.T) {
+	stub := &stubLLM{}
+	st := store.NewMemory(0)
+	svc := service.NewService(stub, zap.NewNop(), service.WithStore(st), service.WithHistoryTurns(1))
+
+	p := &service.Pipeline{
+		Name: "memory",
+		Stages: []service.Stage{
+			{ID: "agents", Tasks: service.TemplateTasks(service.TaskTemplate{ID: "llm-1", System: tmpl("agent.system", "agent")})},
+			service.CombineStage("combine", nil, "agents"),
+		},
+	}
+	var asked int
+	ask := func(conversationID, message string) {
+		t.Helper()
+		asked++
+		eventChan := make(chan service.StatusEvent, 16)
+		wait := collectEvents(eventChan)
+		err := svc.RunPipeline(context.Background(), fmt.Sprintf("msg-%d", asked), conversationID, message, p, eventChan)
+		wait()
+		require.NoError(t, err)
+	}
+
+	ask("conv-1", "first")
+	require.Len(t, stub.combine, 2, "a new conversation has no history")
+
+	ask("conv-1", "second")
+	ask("conv-1", "third")
+	// Only the last turn fits the window of one
+	require.Equal(t, []llm.ChatMessage{
+		{Role: "user", Content: "second"},
+		{Role: "assistant", Content: "combined"},
+	}, stub.combine[1:3])
+	require.Equal(t, "user", stub.combine[3].Role)
+
+	ask("conv-2", "other")
+	require.Len(t, stub.combine, 2, "conversations don't share history")
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"time"
+
+	"llmsse/internal/prompt"
+	"llmsse/internal/store"
+)
+
+// ReasoningMode controls what happens to thinking output of reasoning models.
+type ReasoningMode string
+
+const (
+	// ReasoningHide drops reasoning; only usage accounting reflects it.
+	ReasoningHide ReasoningMode = "hide"
+	// ReasoningForward sends reasoning to the client as "Reasoning" events.
+	ReasoningForward ReasoningMode = "forward"
+)
+
+// ProcessOptions are per-request settings for ProcessMessage.
+type ProcessOptions struct {
+	Reasoning ReasoningMode
+	// Policy overrides the service's default completion policy when set
+	Policy *CompletionPolicy
+	// CombineTimeout overrides the service's default combine timeout
+	CombineTimeout time.Duration
+	// StreamAgents overrides whether agents stream their tokens when set
+	StreamAgents *bool
+	// Combiner replaces the strategy of a pipeline's combine stage
+	Combiner Combiner
+	// Locale and History are available to prompt templates
+	Locale  string
+	History []prompt.Turn
+	// RequestHash is recorded with the message to recognize retries of the
+	// request
+	RequestHash string
+	// OnEnd is called with the message's final record once the pipeline has
+	// completed or failed
+	OnEnd func(store.Message)
+}
+
+type ProcessOption func(*ProcessOptions)
+
+// WithReasoning selects whether reasoning deltas are forwarded or hidden.
+func WithReasoning(mode ReasoningMode) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.Reasoning = mode
+	}
+}
+
+// WithPolicy overrides the completion policy for one request.
+func WithPolicy(p CompletionPolicy) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.Policy = &p
+	}
+}
+
+// WithCombineTimeout bounds the combine step of one request.
+func WithCombineTimeout(d time.Duration) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.CombineTimeout = d
+	}
+}
+
+// WithStreamAgents turns agent token streaming on or off for one request.
+func WithStreamAgents(enabled bool) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.StreamAgents = &enabled
+	}
+}
+
+// WithCombiner picks the combine strategy for one request.
+func WithCombiner(c Combiner) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.Combiner = c
+	}
+}
+
+// WithLocale sets the locale prompt templates see.
+func WithLocale(locale string) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.Locale = locale
+	}
+}
+
+// WithHistory sets the earlier turns of the conversation.
+func WithHistory(turns []prompt.Turn) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.History = turns
+	}
+}
+
+// WithRequestHash records hash, identifying the request, with the message.
+func WithRequestHash(hash string) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.RequestHash = hash
+	}
+}
+
+// WithOnEnd calls fn with the final record of the message, with its answer,
+// usage and agent outputs, once it has completed or failed.
+func WithOnEnd(fn func(store.Message)) ProcessOption {
+	return func(o *ProcessOptions) {
+		o.OnEnd = fn
+	}
+}
+
+func (o ProcessOptions) streamAgents(fallback bool) bool {
+	if o.StreamAgents != nil {
+		return *o.StreamAgents
+	}
+	return fallback
+}
+
+func (o ProcessOptions) policy(fallback CompletionPolicy) CompletionPolicy {
+	if o.Policy != nil {
+		return *o.Policy
+	}
+	return fallback
+}
+
+func newProcessOptions(opts []ProcessOption) ProcessOptions {
+	o := ProcessOptions{Reasoning: ReasoningHide}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
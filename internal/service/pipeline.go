@@ -0,0 +1,541 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+	"llmsse/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// Pipeline is a DAG of stages. Stages whose dependencies have finished run
+// concurrently; exactly one stage is Final and streams the answer.
+type Pipeline struct {
+	Name   string
+	Stages []Stage
+	// MaxParallel caps how many stages run at once; zero means no limit.
+	MaxParallel int
+}
+
+type Stage struct {
+	ID        string
+	DependsOn []string
+	// When, if set, is checked once the dependencies have finished. The stage
+	// is skipped when it returns false, which is how pipelines branch.
+	When func(in StageInput) bool
+	// Tasks builds the stage's calls from the message and earlier outputs.
+	Tasks func(in StageInput) ([]PromptTask, error)
+	// Policy overrides the service's completion policy for this stage.
+	Policy *CompletionPolicy
+	// Final marks the stage that answers the client: its single task is
+	// streamed, or Combine merges the results of its dependencies.
+	Final   bool
+	Combine Combiner
+	// Debate runs the stage's agents over several rounds, each seeing the
+	// others' previous answers.
+	Debate *Debate
+	// Vote samples each task several times and keeps the majority answer.
+	Vote *Vote
+}
+
+// StageInput is what a stage sees: the user message and the outputs of every
+// stage it depends on, directly or transitively.
+type StageInput struct {
+	MessageID      string
+	ConversationID string
+	Message        string
+	History        []prompt.Turn
+	Locale         string
+	Outputs        map[string]StageOutput
+	// Inputs lists the direct dependencies in declaration order.
+	Inputs []string
+
+	prompts *prompt.Registry
+}
+
+type StageOutput struct {
+	Stage string
+	// Text is the single answer of a one-task stage, or the successful
+	// answers joined by separators.
+	Text    string
+	Results []LLMResult
+	Skipped bool
+	// Usage covers every call the stage made, including ones whose results
+	// were superseded, such as earlier debate rounds.
+	Usage *llm.Usage
+}
+
+// Combined renders the results of the given stages, or of the direct inputs
+// when none are named, as sections labeled with the agent that wrote them and
+// led by a note naming the agents that didn't answer.
+func (in StageInput) Combined(stages ...string) string {
+	return promptInputs(in.results(stages))
+}
+
+func (in StageInput) results(stages []string) []LLMResult {
+	if len(stages) == 0 {
+		stages = in.Inputs
+	}
+	var results []LLMResult
+	for _, id := range stages {
+		results = append(results, in.Outputs[id].Results...)
+	}
+	return results
+}
+
+// StaticTasks returns a Tasks function that always yields tasks.
+func StaticTasks(tasks ...PromptTask) func(StageInput) ([]PromptTask, error) {
+	return func(StageInput) ([]PromptTask, error) {
+		return tasks, nil
+	}
+}
+
+// CombineStage is a final stage that merges the outputs of dependsOn with
+// combiner, LLM synthesis when nil.
+func CombineStage(id string, combiner Combiner, dependsOn ...string) Stage {
+	return Stage{
+		ID:        id,
+		DependsOn: dependsOn,
+		Final:     true,
+		Combine:   cmp.Or[Combiner](combiner, synthesisCombiner{}),
+	}
+}
+
+// FanOutPipeline runs tasks in parallel and combines their answers.
+func FanOutPipeline(name string, tasks []PromptTask) *Pipeline {
+	return &Pipeline{
+		Name: name,
+		Stages: []Stage{
+			{ID: "agents", Tasks: StaticTasks(tasks...)},
+			CombineStage("combine", nil, "agents"),
+		},
+	}
+}
+
+// Validate checks that stage IDs are unique, dependencies exist, the graph is
+// acyclic and there is exactly one unconditional final stage nothing depends on.
+func (p *Pipeline) Validate() error {
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("pipeline %q has no stages", p.Name)
+	}
+
+	index := make(map[string]*Stage, len(p.Stages))
+	var final *Stage
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		switch {
+		case st.ID == "":
+			return fmt.Errorf("pipeline %q: stage %d has no id", p.Name, i)
+		case index[st.ID] != nil:
+			return fmt.Errorf("pipeline %q: duplicate stage %q", p.Name, st.ID)
+		case st.Tasks == nil && st.Combine == nil:
+			return fmt.Errorf("pipeline %q: stage %q has no tasks", p.Name, st.ID)
+		case st.Combine != nil && !st.Final:
+			return fmt.Errorf("pipeline %q: stage %q combines but is not final", p.Name, st.ID)
+		case st.Debate != nil && (st.Final || st.Combine != nil):
+			return fmt.Errorf("pipeline %q: debate stage %q cannot be final", p.Name, st.ID)
+		case st.Vote != nil && (st.Final || st.Combine != nil || st.Debate != nil):
+			return fmt.Errorf("pipeline %q: vote stage %q cannot be final or a debate", p.Name, st.ID)
+		}
+		index[st.ID] = st
+
+		if st.Final {
+			if final != nil {
+				return fmt.Errorf("pipeline %q: stages %q and %q are both final", p.Name, final.ID, st.ID)
+			}
+			if st.When != nil {
+				return fmt.Errorf("pipeline %q: final stage %q cannot be conditional", p.Name, st.ID)
+			}
+			final = st
+		}
+	}
+	if final == nil {
+		return fmt.Errorf("pipeline %q has no final stage", p.Name)
+	}
+
+	for _, st := range p.Stages {
+		for _, dep := range st.DependsOn {
+			switch {
+			case index[dep] == nil:
+				return fmt.Errorf("pipeline %q: stage %q depends on unknown stage %q", p.Name, st.ID, dep)
+			case dep == final.ID:
+				return fmt.Errorf("pipeline %q: stage %q depends on final stage %q", p.Name, st.ID, dep)
+			}
+		}
+	}
+
+	// Depth-first search for cycles
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(p.Stages))
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("pipeline %q: dependency cycle %s", p.Name, strings.Join(append(path, id), " -> "))
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, dep := range index[id].DependsOn {
+			if err := visit(dep, append(path, id)); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, st := range p.Stages {
+		if err := visit(st.ID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ancestors returns, for every stage, the set of stages it transitively
+// depends on. The pipeline must be valid.
+func (p *Pipeline) ancestors() map[string]map[string]bool {
+	index := make(map[string]*Stage, len(p.Stages))
+	for i := range p.Stages {
+		index[p.Stages[i].ID] = &p.Stages[i]
+	}
+
+	out := make(map[string]map[string]bool, len(p.Stages))
+	var collect func(id string) map[string]bool
+	collect = func(id string) map[string]bool {
+		if set, ok := out[id]; ok {
+			return set
+		}
+		set := make(map[string]bool)
+		for _, dep := range index[id].DependsOn {
+			set[dep] = true
+			for a := range collect(dep) {
+				set[a] = true
+			}
+		}
+		out[id] = set
+		return set
+	}
+	for _, st := range p.Stages {
+		collect(st.ID)
+	}
+	return out
+}
+
+type stageResult struct {
+	id  string
+	out StageOutput
+	err error
+}
+
+// ErrCancelled is the cause to cancel a pipeline's context with to stop it
+// on request. The pipeline then ends with a cancelled event and returns
+// ErrCancelled.
+var ErrCancelled = errors.New("cancelled")
+
+// RunPipeline executes p for one message and streams status events, the
+// final stage's answer and a closing Completed event carrying the usage of
+// every call. A stage error stops the stages still running and is returned.
+func (s *Service) RunPipeline(
+	ctx context.Context,
+	messageID, conversationID, message string,
+	p *Pipeline,
+	stream chan<- StatusEvent,
+	opts ...ProcessOption,
+) (err error) {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	r := &run{
+		messageID:      messageID,
+		conversationID: conversationID,
+		stream:         stream,
+		opts:           newProcessOptions(opts),
+		prompts:        s.prompts.Current(),
+	}
+	if r.opts.History == nil {
+		r.opts.History = s.history(ctx, r)
+	}
+	start := time.Now()
+	s.logger.Debug("Running pipeline", r.logFields(zap.String("pipeline", p.Name))...)
+
+	g, gctx := newGroup(ctx)
+	defer g.Stop(nil)
+
+	ancestors := p.ancestors()
+	waiting := make(map[string]int, len(p.Stages))
+	dependents := make(map[string][]*Stage, len(p.Stages))
+	var ready []*Stage
+	var final *Stage
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		waiting[st.ID] = len(st.DependsOn)
+		for _, dep := range st.DependsOn {
+			dependents[dep] = append(dependents[dep], st)
+		}
+		if len(st.DependsOn) == 0 {
+			ready = append(ready, st)
+		}
+		if st.Final {
+			final = st
+		}
+	}
+
+	outputs := make(map[string]StageOutput, len(p.Stages))
+	started := make(map[string]bool, len(p.Stages))
+	finish := func(id string, out StageOutput) {
+		outputs[id] = out
+		for _, st := range dependents[id] {
+			waiting[st.ID]--
+			if waiting[st.ID] == 0 {
+				ready = append(ready, st)
+			}
+		}
+	}
+
+	done := make(chan stageResult, len(p.Stages))
+	running := 0
+	usage := &llm.Usage{}
+
+	msg := store.Message{
+		ID:             messageID,
+		ConversationID: conversationID,
+		Pipeline:       p.Name,
+		Content:        message,
+		CreatedAt:      start,
+		RequestHash:    r.opts.RequestHash,
+	}
+	s.recordStart(ctx, r, msg)
+	recorded := false
+	defer func() {
+		cancelled := err != nil && errors.Is(context.Cause(ctx), ErrCancelled)
+		if cancelled {
+			err = ErrCancelled
+		}
+		if !recorded {
+			s.recordEnd(ctx, r, msg, p, outputs, usage, err)
+		}
+		if cancelled {
+			s.cancelled(ctx, r, p, started, outputs, usage)
+		}
+	}()
+
+	for len(outputs) < len(p.Stages) {
+		for len(ready) > 0 && (p.MaxParallel <= 0 || running < p.MaxParallel) {
+			st := ready[0]
+			ready = ready[1:]
+
+			in := StageInput{
+				MessageID:      messageID,
+				ConversationID: conversationID,
+				Message:        message,
+				History:        r.opts.History,
+				Locale:         r.opts.Locale,
+				Outputs:        make(map[string]StageOutput, len(ancestors[st.ID])),
+				Inputs:         st.DependsOn,
+				prompts:        r.prompts,
+			}
+			for id := range ancestors[st.ID] {
+				in.Outputs[id] = outputs[id]
+			}
+
+			if st.When != nil && !st.When(in) {
+				s.logger.Debug("Stage skipped", r.logFields(zap.String("stage", st.ID))...)
+				if !r.emit(ctx, StatusEvent{Status: StatusStageSkipped, Source: st.ID, Stage: st.ID}) {
+					return ctx.Err()
+				}
+				finish(st.ID, StageOutput{Stage: st.ID, Skipped: true})
+				continue
+			}
+
+			if !r.emit(ctx, StatusEvent{Status: StatusStageStarted, Source: st.ID, Stage: st.ID}) {
+				return ctx.Err()
+			}
+			started[st.ID] = true
+			running++
+			g.Go(func() {
+				out, err := s.runStage(gctx, r, st, in)
+				done <- stageResult{id: st.ID, out: out, err: err}
+			})
+		}
+		if running == 0 {
+			// Unreachable for a validated pipeline
+			return fmt.Errorf("pipeline %q stalled", p.Name)
+		}
+
+		res := <-done
+		running--
+		if res.err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.logger.Warn("Stage failed", r.logFields(
+				zap.String("pipeline", p.Name),
+				zap.String("stage", res.id),
+				zap.Error(res.err),
+			)...)
+			g.Stop(res.err)
+			return fmt.Errorf("stage %s: %w", res.id, res.err)
+		}
+
+		usage.Add(res.out.Usage)
+		if !r.emit(ctx, StatusEvent{Status: StatusStageCompleted, Source: res.id, Stage: res.id}) {
+			return ctx.Err()
+		}
+		finish(res.id, res.out)
+	}
+
+	s.recordEnd(ctx, r, msg, p, outputs, usage, nil)
+	recorded = true
+
+	var source, template string
+	if results := outputs[final.ID].Results; len(results) > 0 {
+		source, template = results[0].ID, results[0].Template
+	}
+	if !r.emit(ctx, StatusEvent{
+		Status:   StatusCompleted,
+		Source:   source,
+		Template: template,
+		Stage:    final.ID,
+		Usage:    usage,
+		Final:    true,
+	}) {
+		return ctx.Err()
+	}
+
+	s.logger.Debug("Pipeline completed", r.logFields(
+		zap.String("pipeline", p.Name),
+		zap.Duration("elapsed", time.Since(start)),
+	)...)
+	return nil
+}
+
+// cancelled reports how far p got before it was cancelled. The event goes
+// out on a context of its own, as ctx is done.
+func (s *Service) cancelled(
+	ctx context.Context,
+	r *run,
+	p *Pipeline,
+	started map[string]bool,
+	outputs map[string]StageOutput,
+	usage *llm.Usage,
+) {
+	progress := &Progress{Stages: len(p.Stages), Completed: []string{}}
+	for _, st := range p.Stages {
+		out, ok := outputs[st.ID]
+		switch {
+		case ok && out.Skipped:
+			progress.Skipped = append(progress.Skipped, st.ID)
+		case ok:
+			progress.Completed = append(progress.Completed, st.ID)
+		case started[st.ID]:
+			progress.Running = append(progress.Running, st.ID)
+		}
+	}
+
+	s.logger.Info("Pipeline cancelled", r.logFields(
+		zap.String("pipeline", p.Name),
+		zap.Strings("completed", progress.Completed),
+		zap.Strings("running", progress.Running),
+	)...)
+	r.emit(context.WithoutCancel(ctx), StatusEvent{
+		Status:   StatusCancelled,
+		Message:  fmt.Sprintf("Cancelled after %d of %d stages", len(progress.Completed)+len(progress.Skipped), progress.Stages),
+		Progress: progress,
+		Usage:    usage,
+		Final:    true,
+	})
+}
+
+func (s *Service) runStage(ctx context.Context, r *run, st *Stage, in StageInput) (StageOutput, error) {
+	if st.Combine != nil {
+		return s.runCombiner(ctx, r, st, in)
+	}
+
+	tasks, err := st.Tasks(in)
+	if err != nil {
+		return StageOutput{}, err
+	}
+	if len(tasks) == 0 {
+		return StageOutput{}, errors.New("stage produced no tasks")
+	}
+
+	if st.Final {
+		if len(tasks) != 1 {
+			return StageOutput{}, fmt.Errorf("final stage must produce one task, got %d", len(tasks))
+		}
+		res, err := s.streamFinal(ctx, r, st, tasks[0])
+		if err != nil {
+			return StageOutput{}, err
+		}
+		return StageOutput{Stage: st.ID, Text: res.Message, Results: []LLMResult{res}, Usage: res.Usage}, nil
+	}
+
+	if st.Debate != nil {
+		return s.runDebate(ctx, r, st, tasks)
+	}
+	if st.Vote != nil {
+		return s.runVote(ctx, r, st, tasks)
+	}
+
+	results, err := s.runTasksInParallel(ctx, r, st.ID, tasks, s.stagePolicy(r, st))
+	if err != nil {
+		return StageOutput{}, err
+	}
+	usage := &llm.Usage{}
+	for _, res := range results {
+		usage.Add(res.Usage)
+	}
+	return stageOutput(st.ID, results, usage), nil
+}
+
+func (s *Service) stagePolicy(r *run, st *Stage) CompletionPolicy {
+	policy := s.policy
+	if st.Policy != nil {
+		policy = *st.Policy
+	}
+	return r.opts.policy(policy)
+}
+
+func stageOutput(id string, results []LLMResult, usage *llm.Usage) StageOutput {
+	var answers []string
+	for _, res := range results {
+		if res.Err == nil {
+			answers = append(answers, res.Message)
+		}
+	}
+	return StageOutput{Stage: id, Text: strings.Join(answers, "\n---\n"), Results: results, Usage: usage}
+}
+
+func (s *Service) runCombiner(ctx context.Context, r *run, st *Stage, in StageInput) (StageOutput, error) {
+	combiner := cmp.Or(r.opts.Combiner, st.Combine)
+	s.logger.Debug("Combining", r.logFields(
+		zap.String("stage", st.ID),
+		zap.String("strategy", combiner.Name()),
+	)...)
+
+	c := &Combination{
+		Message: in.Message,
+		Results: in.results(nil),
+		s:       s,
+		r:       r,
+		stage:   st,
+	}
+	if err := combiner.Combine(ctx, c); err != nil {
+		return StageOutput{}, fmt.Errorf("%s combine: %w", combiner.Name(), err)
+	}
+
+	res := c.result()
+	return StageOutput{Stage: st.ID, Text: res.Message, Results: []LLMResult{res}, Usage: res.Usage}, nil
+}
@@ -0,0 +1,152 @@
+package service_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"llmsse/internal/prompt"
+	"llmsse/internal/service"
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func tmpl(id, text string) *prompt.Template {
+	return prompt.Must(id, "v1", text)
+}
+
+func TestRunPipeline_BranchingDAG(t *testing.T) {
+	stub := &stubLLM{}
+	svc := service.NewService(stub, zap.NewNop())
+
+	p := &service.Pipeline{
+		Name: "experts",
+		Stages: []service.Stage{
+			{ID: "classify", Tasks: service.TemplateTasks(service.TaskTemplate{ID: "classifier", System: tmpl("classifier.system", "classify")})},
+			{
+				ID:        "code",
+				DependsOn: []string{"classify"},
+				When: func(in service.StageInput) bool {
+					return strings.Contains(in.Outputs["classify"].Text, "code")
+				},
+				Tasks: service.TemplateTasks(service.TaskTemplate{ID: "coder", System: tmpl("coder.system", "coder")}),
+			},
+			{
+				ID:        "general",
+				DependsOn: []string{"classify"},
+				When: func(in service.StageInput) bool {
+					return !strings.Contains(in.Outputs["classify"].Text, "code")
+				},
+				Tasks: service.TemplateTasks(
+					service.TaskTemplate{ID: "expert-1", System: tmpl("expert-1.system", "expert 1")},
+					service.TaskTemplate{ID: "expert-2", System: tmpl("expert-2.system", "expert 2")},
+				),
+			},
+			{
+				ID:        "critique",
+				DependsOn: []string{"code", "general"},
+				Tasks: service.TemplateTasks(service.TaskTemplate{
+					ID:     "critic",
+					System: tmpl("critic.system", "critic"),
+					Prompt: tmpl("critic.prompt", "{{.Message}}\n{{.Inputs}}"),
+				}),
+			},
+			{
+				ID:        "final",
+				DependsOn: []string{"critique"},
+				Final:     true,
+				Tasks: service.TemplateTasks(service.TaskTemplate{
+					ID:     "synth",
+					System: tmpl("synth.system", "synthesize"),
+					Prompt: tmpl("synth.prompt", "{{.Results.classifier}} | {{.Outputs.critique}}"),
+				}),
+			},
+		},
+	}
+
+	eventChan := make(chan service.StatusEvent, 64)
+	wait := collectEvents(eventChan)
+	err := svc.RunPipeline(context.Background(), "msg-1", "conv-1", "why is the sky blue?", p, eventChan)
+	events := wait()
+	require.NoError(t, err)
+
+	stages := map[service.Status][]string{}
+	for _, e := range events {
+		require.Equal(t, "msg-1", e.MessageID)
+		switch e.Status {
+		case service.StatusStageStarted, service.StatusStageCompleted, service.StatusStageSkipped:
+			stages[e.Status] = append(stages[e.Status], e.Stage)
+		}
+	}
+	require.Equal(t, []string{"code"}, stages[service.StatusStageSkipped])
+	require.ElementsMatch(t, []string{"classify", "general", "critique", "final"}, stages[service.StatusStageCompleted])
+
+	last := events[len(events)-1]
+	require.Equal(t, service.StatusCompleted, last.Status)
+	require.True(t, last.Final)
+	require.Equal(t, "final", last.Stage)
+	require.Equal(t, "synth.system@v1,synth.prompt@v1", last.Template)
+
+	require.Equal(t, "answer from classify | answer from critic", stub.combine[1].Content)
+}
+
+func TestPipeline_Validate(t *testing.T) {
+	tasks := service.StaticTasks()
+	tests := []struct {
+		name   string
+		stages []service.Stage
+		want   string
+	}{
+		{"no final", []service.Stage{{ID: "a", Tasks: tasks}}, "no final stage"},
+		{"duplicate", []service.Stage{{ID: "a", Tasks: tasks}, {ID: "a", Tasks: tasks, Final: true}}, "duplicate stage"},
+		{"unknown dependency", []service.Stage{{ID: "a", DependsOn: []string{"b"}, Tasks: tasks, Final: true}}, "unknown stage"},
+		{"cycle", []service.Stage{
+			{ID: "a", DependsOn: []string{"b"}, Tasks: tasks},
+			{ID: "b", DependsOn: []string{"a"}, Tasks: tasks},
+			{ID: "c", DependsOn: []string{"a"}, Tasks: tasks, Final: true},
+		}, "cycle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &service.Pipeline{Name: "p", Stages: tt.stages}
+			require.ErrorContains(t, p.Validate(), tt.want)
+		})
+	}
+}
+
+func TestRunPipeline_Cancelled(t *testing.T) {
+	st := store.NewMemory(0)
+	stub := &stubLLM{replies: map[string]error{"agent 2": errBlock}}
+	svc := service.NewService(stub, zap.NewNop(), service.WithStore(st))
+	p := service.FanOutPipeline("fan-out", agentTasks(2))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	eventChan := make(chan service.StatusEvent)
+	var events []service.StatusEvent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range eventChan {
+			events = append(events, e)
+			if e.Status == service.StatusStageStarted {
+				cancel(service.ErrCancelled)
+			}
+		}
+	}()
+
+	err := svc.RunPipeline(ctx, "msg-1", "", "q", p, eventChan)
+	close(eventChan)
+	<-done
+	require.ErrorIs(t, err, service.ErrCancelled)
+
+	last := events[len(events)-1]
+	require.Equal(t, service.StatusCancelled, last.Status)
+	require.True(t, last.Final)
+	require.Equal(t, &service.Progress{Stages: 2, Completed: []string{}, Running: []string{"agents"}}, last.Progress)
+
+	msg, err := st.Message(context.Background(), "msg-1")
+	require.NoError(t, err)
+	require.Equal(t, store.StatusCancelled, msg.Status)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type PolicyMode string
+
+const (
+	// PolicyAll fails the request as soon as any agent fails.
+	PolicyAll PolicyMode = "all"
+	// PolicyQuorum needs at least Min agents to succeed and fails as soon as
+	// that is no longer possible.
+	PolicyQuorum PolicyMode = "quorum"
+	// PolicyBestEffort waits for every agent and proceeds with whatever
+	// succeeded, as long as at least Min (default 1) did.
+	PolicyBestEffort PolicyMode = "best_effort"
+)
+
+// CompletionPolicy decides how many agents of a fan-out must succeed for the
+// request to continue to the combine step.
+type CompletionPolicy struct {
+	Mode PolicyMode
+	Min  int
+}
+
+// ParsePolicy reads the "all", "quorum:N" and "best_effort[:N]" forms used in
+// configuration and requests.
+func ParsePolicy(s string) (CompletionPolicy, error) {
+	mode, arg, hasArg := strings.Cut(strings.TrimSpace(s), ":")
+
+	p := CompletionPolicy{Mode: PolicyMode(mode)}
+	switch p.Mode {
+	case "", PolicyAll:
+		if hasArg {
+			return CompletionPolicy{}, fmt.Errorf("policy %q takes no argument", s)
+		}
+		return CompletionPolicy{Mode: PolicyAll}, nil
+	case PolicyQuorum, PolicyBestEffort:
+		if !hasArg {
+			if p.Mode == PolicyQuorum {
+				return CompletionPolicy{}, fmt.Errorf("policy %q needs a minimum, e.g. quorum:2", s)
+			}
+			p.Min = 1
+			return p, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return CompletionPolicy{}, fmt.Errorf("policy %q: minimum must be a positive integer", s)
+		}
+		p.Min = n
+		return p, nil
+	default:
+		return CompletionPolicy{}, fmt.Errorf("unknown completion policy %q", s)
+	}
+}
+
+func (p CompletionPolicy) String() string {
+	if p.Mode == "" || p.Mode == PolicyAll {
+		return string(PolicyAll)
+	}
+	return fmt.Sprintf("%s:%d", p.Mode, p.Min)
+}
+
+// required returns how many of total agents must succeed.
+func (p CompletionPolicy) required(total int) int {
+	switch p.Mode {
+	case PolicyQuorum:
+		return min(p.Min, total)
+	case PolicyBestEffort:
+		return min(max(p.Min, 1), total)
+	default:
+		return total
+	}
+}
+
+// failFast reports whether the request should stop now that failed agents
+// have failed, rather than waiting for the rest.
+func (p CompletionPolicy) failFast(failed, total int) bool {
+	if p.Mode == PolicyBestEffort {
+		return false
+	}
+	return failed > total-p.required(total)
+}
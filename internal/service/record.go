@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/store"
+
+	"go.uber.org/zap"
+)
+
+// WithStore records every message the service runs in st: when it starts,
+// and with its answer, agent outputs and usage once it ends.
+func WithStore(st store.Store) Option {
+	return func(s *Service) {
+		s.store = st
+	}
+}
+
+// recordStart stores msg as running.
+func (s *Service) recordStart(ctx context.Context, r *run, msg store.Message) {
+	msg.Status = store.StatusRunning
+	s.save(ctx, r, msg)
+}
+
+// recordEnd stores the outcome of msg. The outputs of every stage that ran
+// are kept, also when the pipeline failed.
+func (s *Service) recordEnd(
+	ctx context.Context,
+	r *run,
+	msg store.Message,
+	p *Pipeline,
+	outputs map[string]StageOutput,
+	usage *llm.Usage,
+	err error,
+) {
+	now := time.Now()
+	msg.CompletedAt = &now
+	msg.Usage = *usage
+	switch {
+	case errors.Is(err, ErrCancelled):
+		msg.Status = store.StatusCancelled
+		msg.Error, msg.ErrorClass = storedError(err)
+	case err != nil:
+		msg.Status = store.StatusFailed
+		msg.Error, msg.ErrorClass = storedError(err)
+	default:
+		msg.Status = store.StatusCompleted
+	}
+
+	for _, st := range p.Stages {
+		out := outputs[st.ID]
+		if st.Final {
+			msg.Answer = out.Text
+		}
+		for _, res := range out.Results {
+			o := store.Output{Stage: st.ID, Agent: res.ID, Template: res.Template, Content: res.Message}
+			if res.Err != nil {
+				o.Error, o.ErrorClass = storedError(res.Err)
+			}
+			if res.Usage != nil {
+				o.Usage = *res.Usage
+			}
+			msg.Outputs = append(msg.Outputs, o)
+		}
+	}
+	// The request may have ended because ctx did; its record still belongs
+	// in the store
+	s.save(context.WithoutCancel(ctx), r, msg)
+	if r.opts.OnEnd != nil {
+		r.opts.OnEnd(msg)
+	}
+}
+
+// storedError describes err in the client-safe terms of llm.ErrorMessage,
+// as records are served back over the API; the full error is only logged.
+func storedError(err error) (message, class string) {
+	if errors.Is(err, ErrCancelled) {
+		err = context.Canceled
+	}
+	return llm.ErrorMessage(err), string(llm.ClassifyError(err))
+}
+
+func (s *Service) save(ctx context.Context, r *run, msg store.Message) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.SaveMessage(ctx, msg); err != nil {
+		s.logger.Error("Failed to store message", r.logFields(
+			zap.String("status", string(msg.Status)),
+			zap.Error(err),
+		)...)
+	}
+}
@@ -0,0 +1,66 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"llmsse/internal/service"
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRunPipeline_RecordsMessages(t *testing.T) {
+	st := store.NewMemory(0)
+	stub := &stubLLM{replies: map[string]error{"agent 2": errors.New("boom")}}
+	svc := service.NewService(stub, zap.NewNop(),
+		service.WithStore(st),
+		service.WithHistoryTurns(5),
+		service.WithCompletionPolicy(service.CompletionPolicy{Mode: service.PolicyBestEffort, Min: 1}),
+	)
+	p := service.FanOutPipeline("fan-out", agentTasks(2))
+
+	eventChan := make(chan service.StatusEvent, 32)
+	wait := collectEvents(eventChan)
+	err := svc.RunPipeline(context.Background(), "msg-1", "conv-1", "q", p, eventChan)
+	wait()
+	require.NoError(t, err)
+
+	msg, err := st.Message(context.Background(), "msg-1")
+	require.NoError(t, err)
+	require.Equal(t, store.StatusCompleted, msg.Status)
+	require.Equal(t, "combined", msg.Answer)
+	require.Equal(t, "fan-out", msg.Pipeline)
+	require.NotNil(t, msg.CompletedAt)
+	require.Len(t, msg.Outputs, 3)
+	require.Equal(t, "answer from agent 1", msg.Outputs[0].Content)
+	// Records are served back over the API, so they keep the sanitized error
+	require.Equal(t, "processing failed", msg.Outputs[1].Error)
+	require.Equal(t, "unknown", msg.Outputs[1].ErrorClass)
+	require.Equal(t, "combine", msg.Outputs[2].Stage)
+
+	history, err := st.History(context.Background(), "conv-1", 5)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	// A failed pipeline is recorded with its error
+	svc = service.NewService(stub, zap.NewNop(), service.WithStore(st))
+	eventChan = make(chan service.StatusEvent, 32)
+	wait = collectEvents(eventChan)
+	var ended store.Message
+	err = svc.RunPipeline(context.Background(), "msg-2", "conv-1", "q", p, eventChan,
+		service.WithOnEnd(func(m store.Message) { ended = m }),
+	)
+	wait()
+	require.Error(t, err)
+	require.Equal(t, store.StatusFailed, ended.Status)
+	require.Equal(t, "processing failed", ended.Error)
+
+	msg, err = st.Message(context.Background(), "msg-2")
+	require.NoError(t, err)
+	require.Equal(t, store.StatusFailed, msg.Status)
+	require.Equal(t, "processing failed", msg.Error)
+	require.Equal(t, "unknown", msg.ErrorClass)
+}
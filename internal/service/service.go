@@ -1,11 +1,16 @@
 package service
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+	"llmsse/internal/store"
 	"strings"
-	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -15,192 +20,582 @@ type StatusEvent struct {
 	ConversationID string `json:"conversation_id,omitempty"`
 	Status         Status `json:"status"`
 	Source         string `json:"source,omitempty"`
-	Message        string `json:"message,omitempty"`
-	Final          bool   `json:"final,omitempty"`
+	Stage          string `json:"stage,omitempty"`
+	Round          int    `json:"round,omitempty"`
+	// Template names the prompt templates behind the output, as id@version
+	Template   string `json:"template,omitempty"`
+	Message    string `json:"message,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+	// Votes summarizes a self-consistency vote on "Voted" events
+	Votes *VoteSummary `json:"votes,omitempty"`
+	// Usage is reported on the final event, summed over every LLM call
+	Usage *llm.Usage `json:"usage,omitempty"`
+	// Progress tells how far a cancelled pipeline got
+	Progress *Progress `json:"progress,omitempty"`
+	Final    bool      `json:"final,omitempty"`
+}
+
+// Progress lists the stages of a pipeline by how far they got.
+type Progress struct {
+	Stages    int      `json:"stages"`
+	Completed []string `json:"completed"`
+	Skipped   []string `json:"skipped,omitempty"`
+	Running   []string `json:"running,omitempty"`
 }
 
 type Status string
 
+const (
+	StatusStreaming Status = "Streaming"
+	// StatusAgentStreaming carries a token of an agent's answer, as opposed to
+	// the final answer's StatusStreaming tokens.
+	StatusAgentStreaming Status = "Agent streaming"
+	StatusReasoning      Status = "Reasoning"
+	StatusCompleted      Status = "Completed"
+	StatusFailed         Status = "Failed"
+	StatusTimeout        Status = "Timeout"
+	// StatusCancelled ends a pipeline cancelled with ErrCancelled.
+	StatusCancelled Status = "cancelled"
+
+	StatusStageStarted   Status = "Stage started"
+	StatusStageCompleted Status = "Stage completed"
+	StatusStageSkipped   Status = "Stage skipped"
+)
+
 type PromptTask struct {
 	ID     string
 	Prompt []llm.ChatMessage
+	// Template records the prompt templates Prompt was rendered from
+	Template string
+	// Schema, when set, requests structured output. The response is validated
+	// and decoded into LLMResult.Value.
+	Schema *llm.Schema
+	// Model, Temperature and MaxTokens override the client defaults when set
+	Model       string
+	Temperature *float64
+	MaxTokens   int
+	// Timeout bounds this agent's call, overriding the service default.
+	// OnTimeout decides what an overrun means; Fallback is the answer used
+	// under TimeoutFallback, validated against Schema when there is one.
+	Timeout   time.Duration
+	OnTimeout TimeoutPolicy
+	Fallback  string
+}
+
+func (t PromptTask) callOptions() []llm.Option {
+	var opts []llm.Option
+	if t.Model != "" {
+		opts = append(opts, llm.WithModel(t.Model))
+	}
+	if t.Temperature != nil {
+		opts = append(opts, llm.WithTemperature(*t.Temperature))
+	}
+	if t.MaxTokens > 0 {
+		opts = append(opts, llm.WithMaxTokens(t.MaxTokens))
+	}
+	return opts
+}
+
+// fallback returns the task's fallback answer as its result. With a Schema
+// the answer must validate like a model's would, so later stages can rely on
+// Value; otherwise the task fails.
+func (t PromptTask) fallback() LLMResult {
+	if t.Schema == nil {
+		return LLMResult{ID: t.ID, Message: t.Fallback}
+	}
+	value, err := t.Schema.Decode(t.Fallback)
+	if err != nil {
+		return LLMResult{ID: t.ID, Err: fmt.Errorf("%s fallback answer: %w", t.ID, err)}
+	}
+	return LLMResult{ID: t.ID, Message: t.Fallback, Value: value}
 }
 
 type LLMResult struct {
-	ID      string
-	Message string
-	Err     error
+	ID       string
+	Template string
+	Message  string
+	// Value holds the decoded JSON for tasks that declared a Schema.
+	Value     any
+	Reasoning string
+	Usage     *llm.Usage
+	Err       error
+}
+
+// Decode unmarshals a structured result into out.
+func (r LLMResult) Decode(out any) error {
+	if r.Value == nil {
+		return fmt.Errorf("%s returned no structured output", r.ID)
+	}
+	return json.Unmarshal([]byte(r.Message), out)
 }
 
 type Service struct {
-	llm    llm.Interface
-	logger *zap.Logger
+	llm           llm.Interface
+	logger        *zap.Logger
+	schemaRepairs int
+	policy        CompletionPolicy
+	timeouts      Timeouts
+	streamAgents  bool
+	prompts       prompt.Source
+	historyTurns  int
+	store         store.Store
+}
+
+type Option func(*Service)
+
+// WithSchemaRepairs sets how many times an invalid structured response is sent
+// back to the model for correction before the task fails.
+func WithSchemaRepairs(n int) Option {
+	return func(s *Service) {
+		s.schemaRepairs = n
+	}
 }
 
-func NewService(llmClient llm.Interface, logger *zap.Logger) *Service {
-	return &Service{llm: llmClient, logger: logger}
+// WithCompletionPolicy sets the default policy for requests that don't pick
+// their own.
+func WithCompletionPolicy(p CompletionPolicy) Option {
+	return func(s *Service) {
+		s.policy = p
+	}
+}
+
+// WithTimeouts sets the default agent and combine timeouts.
+func WithTimeouts(t Timeouts) Option {
+	return func(s *Service) {
+		s.timeouts = t
+	}
+}
+
+// WithAgentStreaming makes agents stream their answers as "Agent streaming"
+// events by default, instead of reporting only the final answer.
+func WithAgentStreaming(enabled bool) Option {
+	return func(s *Service) {
+		s.streamAgents = enabled
+	}
 }
 
+// WithPrompts sets where the service gets its prompt templates. Each
+// request renders with the templates current when it started.
+func WithPrompts(src prompt.Source) Option {
+	return func(s *Service) {
+		s.prompts = src
+	}
+}
+
+// WithHistoryTurns shows the agents and the combiner of a request the last turns
+// of its conversation. Turns are the completed messages recorded in the
+// store set with WithStore; without one there is no history.
+func WithHistoryTurns(turns int) Option {
+	return func(s *Service) {
+		s.historyTurns = turns
+	}
+}
+
+func NewService(llmClient llm.Interface, logger *zap.Logger, opts ...Option) *Service {
+	s := &Service{
+		llm:           llmClient,
+		logger:        logger,
+		schemaRepairs: 2,
+		policy:        CompletionPolicy{Mode: PolicyAll},
+		timeouts:      Timeouts{OnTimeout: TimeoutSkip},
+		prompts:       prompt.Builtin(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ProcessMessage runs tasks in parallel and streams a combined answer. It is
+// the fixed fan-out/combine flow, expressed as a two-stage pipeline.
 func (s *Service) ProcessMessage(
 	ctx context.Context,
 	messageID, conversationID string,
 	tasks []PromptTask,
 	stream chan<- StatusEvent,
+	opts ...ProcessOption,
 ) error {
+	return s.RunPipeline(ctx, messageID, conversationID, "", FanOutPipeline("fan-out", tasks), stream, opts...)
+}
 
-	results, err := s.runTasksInParallel(ctx, messageID, conversationID, tasks, stream)
-	if err != nil {
-		return err
-	}
+// run carries the per-request state every stage of a pipeline shares.
+type run struct {
+	messageID      string
+	conversationID string
+	stream         chan<- StatusEvent
+	opts           ProcessOptions
+	// round is stamped on events of multi-round stages
+	round int
+	// prompts is the registry as of the start of the request
+	prompts *prompt.Registry
+}
 
-	combinedInput := s.buildCombinedPrompt(results)
+// emit stamps the request IDs on event and delivers it unless ctx ends first.
+func (r *run) emit(ctx context.Context, event StatusEvent) bool {
+	event.MessageID = r.messageID
+	event.ConversationID = r.conversationID
+	event.Round = cmp.Or(event.Round, r.round)
+	return emit(ctx, r.stream, event)
+}
+
+// inRound returns a copy of r whose events carry round.
+func (r *run) inRound(round int) *run {
+	rr := *r
+	rr.round = round
+	return &rr
+}
 
-	return s.streamCombinedLLM(ctx, messageID, conversationID, combinedInput, stream)
+func (r *run) logFields(fields ...zap.Field) []zap.Field {
+	return append(fields,
+		zap.String("message_id", r.messageID),
+		zap.String("conversation_id", r.conversationID),
+	)
 }
 
+// runTasksInParallel fans tasks out under a derived context. A failure the
+// completion policy treats as fatal cancels the remaining agents, and every
+// agent goroutine has returned by the time this function does.
 func (s *Service) runTasksInParallel(
 	ctx context.Context,
-	messageID, conversationID string,
+	r *run,
+	stage string,
 	tasks []PromptTask,
-	stream chan<- StatusEvent,
+	policy CompletionPolicy,
 ) ([]LLMResult, error) {
-	llmResults := make(chan LLMResult, len(tasks))
-	wg := sync.WaitGroup{}
-
-	for _, task := range tasks {
-		wg.Add(1)
-		go func(task PromptTask) {
-			defer wg.Done()
-
-			if ctx.Err() != nil {
-				s.logger.Warn("Skipping task due to cancelled context",
-					zap.String("task", task.ID),
-					zap.String("message_id", messageID),
-					zap.String("conversation_id", conversationID),
-				)
-				return
-			}
+	g, gctx := newGroup(ctx)
+	defer g.Stop(nil)
 
-			s.logger.Debug("Calling " + task.ID)
-			stream <- StatusEvent{
-				MessageID:      messageID,
-				ConversationID: conversationID,
-				Status:         Status("Sending to " + task.ID),
-				Source:         task.ID,
-			}
+	// Every agent sends exactly one result, so the buffer keeps them from
+	// blocking once the collector below has returned
+	type indexed struct {
+		i   int
+		res LLMResult
+	}
+	llmResults := make(chan indexed, len(tasks))
 
-			res, err := s.llm.Call(ctx, task.Prompt)
-			if ctx.Err() != nil {
-				s.logger.Warn("Context cancelled during llm.Call",
-					zap.String("task", task.ID),
-					zap.String("message_id", messageID),
-					zap.String("conversation_id", conversationID),
-				)
-				return
-			}
+	for i, task := range tasks {
+		g.Go(func() {
+			res := s.runTask(gctx, r, stage, task)
+			res.Template = task.Template
+			llmResults <- indexed{i, res}
+		})
+	}
 
-			if err != nil {
-				llmResults <- LLMResult{
-					ID:  task.ID,
-					Err: fmt.Errorf("%s failed: %w", task.ID, err),
-				}
-				return
-			}
-			s.logger.Debug("Response from LLM calling",
-				zap.String("message", res),
-				zap.String("task", task.ID),
-				zap.String("message_id", messageID),
-				zap.String("conversation_id", conversationID),
-			)
+	// Results keep the task order so combining is stable across runs
+	ordered := make([]LLMResult, len(tasks))
+	var succeeded, failed, skipped int
+	var firstFailure, firstSkip error
+	for range tasks {
+		got := <-llmResults
+		res := got.res
+		ordered[got.i] = res
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		if res.Err == nil {
+			succeeded++
+			continue
+		}
 
-			llmResults <- LLMResult{
-				ID:      task.ID,
-				Message: res,
+		var timeoutErr *TimeoutError
+		if errors.As(res.Err, &timeoutErr) {
+			if timeoutErr.Policy == TimeoutFail {
+				g.Stop(res.Err)
+				return nil, res.Err
 			}
-		}(task)
+			skipped++
+			firstSkip = cmp.Or(firstSkip, res.Err)
+			continue
+		}
+
+		failed++
+		firstFailure = cmp.Or(firstFailure, res.Err)
+		s.logger.Warn("Agent failed", r.logFields(
+			zap.String("task", res.ID),
+			zap.String("template", res.Template),
+			zap.String("stage", stage),
+			zap.String("policy", policy.String()),
+			zap.Error(res.Err),
+		)...)
+		if !r.emit(ctx, StatusEvent{
+			Status:     StatusFailed,
+			Source:     res.ID,
+			Template:   res.Template,
+			Stage:      stage,
+			Message:    llm.ErrorMessage(res.Err),
+			ErrorClass: string(llm.ClassifyError(res.Err)),
+		}) {
+			return nil, context.Cause(ctx)
+		}
+
+		if policy.failFast(failed, len(tasks)-skipped) {
+			g.Stop(res.Err)
+			return nil, res.Err
+		}
 	}
 
-	go func() {
-		wg.Wait()
-		close(llmResults)
-	}()
+	// Skipped agents are left out of the count the policy is applied to
+	answered := len(tasks) - skipped
+	if required := policy.required(answered); succeeded < required || succeeded == 0 {
+		err := fmt.Errorf("%d of %d agents succeeded, policy %s requires %d", succeeded, answered, policy, max(required, 1))
+		if cause := cmp.Or(firstFailure, firstSkip); cause != nil {
+			err = fmt.Errorf("%w: %w", err, cause)
+		}
+		return nil, err
+	}
+	return ordered, nil
+}
 
-	var results []LLMResult
-	for res := range llmResults {
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
+func (s *Service) runTask(ctx context.Context, r *run, stage string, task PromptTask) LLMResult {
+	if ctx.Err() != nil {
+		s.logger.Warn("Skipping task due to cancelled context", r.logFields(zap.String("task", task.ID))...)
+		return LLMResult{ID: task.ID, Err: context.Cause(ctx)}
+	}
+
+	s.logger.Debug("Calling " + task.ID)
+	if !r.emit(ctx, StatusEvent{
+		Status:   Status("Sending to " + task.ID),
+		Source:   task.ID,
+		Template: task.Template,
+		Stage:    stage,
+	}) {
+		return LLMResult{ID: task.ID, Err: context.Cause(ctx)}
+	}
+
+	timeoutErr := &TimeoutError{
+		Source:  task.ID,
+		Timeout: cmp.Or(task.Timeout, s.timeouts.Agent),
+		Policy:  cmp.Or(task.OnTimeout, s.timeouts.OnTimeout, TimeoutSkip),
+	}
+	callCtx, cancel := withTimeout(ctx, timeoutErr.Timeout, timeoutErr)
+	defer cancel()
+
+	// Structured output is validated as a whole, so schema tasks never stream
+	streamed := task.Schema == nil && r.opts.streamAgents(s.streamAgents)
+
+	var res LLMResult
+	var err error
+	if streamed {
+		res, err = s.streamTask(callCtx, r, stage, task)
+	} else {
+		res, err = s.callTask(callCtx, task)
+	}
+	if ctx.Err() != nil {
+		s.logger.Warn("Context cancelled during llm.Call", r.logFields(zap.String("task", task.ID))...)
+		return LLMResult{ID: task.ID, Err: context.Cause(ctx)}
+	}
+
+	if callCtx.Err() != nil {
+		s.logger.Warn("Agent timed out", r.logFields(
+			zap.String("task", task.ID),
+			zap.Duration("timeout", timeoutErr.Timeout),
+			zap.String("on_timeout", string(timeoutErr.Policy)),
+		)...)
+		explanation := timeoutErr.explain()
+		var fallback LLMResult
+		if timeoutErr.Policy == TimeoutFallback {
+			fallback = task.fallback()
+			if fallback.Err != nil {
+				explanation = timeoutErr.Error() + "; its fallback answer does not match its schema"
+			}
 		}
-		if res.Err != nil {
-			return nil, res.Err
+		r.emit(ctx, StatusEvent{
+			Status:     StatusTimeout,
+			Source:     task.ID,
+			Template:   task.Template,
+			Stage:      stage,
+			Message:    explanation,
+			ErrorClass: string(llm.ErrorClassTimeout),
+		})
+
+		if timeoutErr.Policy == TimeoutFallback {
+			return fallback
 		}
-		results = append(results, res)
+		return LLMResult{ID: task.ID, Err: timeoutErr}
 	}
 
-	return results, nil
+	if err != nil {
+		return LLMResult{
+			ID:  task.ID,
+			Err: fmt.Errorf("%s failed: %w", task.ID, err),
+		}
+	}
+	s.logger.Debug("Response from LLM calling", r.logFields(
+		zap.String("message", res.Message),
+		zap.String("task", task.ID),
+		zap.String("template", task.Template),
+	)...)
+
+	if r.opts.Reasoning == ReasoningForward && res.Reasoning != "" && !streamed {
+		r.emit(ctx, StatusEvent{
+			Status:   StatusReasoning,
+			Source:   task.ID,
+			Template: task.Template,
+			Stage:    stage,
+			Message:  res.Reasoning,
+		})
+	}
+
+	return res
+}
+
+func (s *Service) callTask(ctx context.Context, task PromptTask) (LLMResult, error) {
+	var (
+		value any
+		res   llm.Completion
+		err   error
+	)
+	if task.Schema == nil {
+		res, err = s.llm.Call(ctx, task.Prompt, task.callOptions()...)
+	} else {
+		value, res, err = llm.CallJSON(ctx, s.llm, task.Prompt, task.Schema, s.schemaRepairs, task.callOptions()...)
+	}
+	if err != nil {
+		return LLMResult{}, err
+	}
+
+	return LLMResult{
+		ID:        task.ID,
+		Message:   res.Content,
+		Value:     value,
+		Reasoning: res.Reasoning,
+		Usage:     res.Usage,
+	}, nil
 }
 
-func (s *Service) buildCombinedPrompt(results []LLMResult) string {
-	var builder strings.Builder
-	for _, res := range results {
-		builder.WriteString(res.Message)
-		builder.WriteString("\n---\n")
+// streamTask runs an agent through Stream, forwarding its tokens while
+// assembling the full answer for later stages.
+func (s *Service) streamTask(ctx context.Context, r *run, stage string, task PromptTask) (LLMResult, error) {
+	res := LLMResult{ID: task.ID, Usage: &llm.Usage{}}
+	var answer, reasoning strings.Builder
+
+	for chunk, err := range s.llm.Stream(ctx, task.Prompt, task.callOptions()...) {
+		if err != nil {
+			return LLMResult{}, err
+		}
+		res.Usage.Add(chunk.Usage)
+
+		if chunk.Reasoning != "" {
+			reasoning.WriteString(chunk.Reasoning)
+			if r.opts.Reasoning == ReasoningForward && !r.emit(ctx, StatusEvent{
+				Status:   StatusReasoning,
+				Source:   task.ID,
+				Template: task.Template,
+				Stage:    stage,
+				Message:  chunk.Reasoning,
+			}) {
+				return LLMResult{}, ctx.Err()
+			}
+		}
+		if chunk.Content == "" {
+			continue
+		}
+
+		answer.WriteString(chunk.Content)
+		if !r.emit(ctx, StatusEvent{
+			Status:   StatusAgentStreaming,
+			Source:   task.ID,
+			Template: task.Template,
+			Stage:    stage,
+			Message:  chunk.Content,
+		}) {
+			return LLMResult{}, ctx.Err()
+		}
+	}
+
+	if answer.Len() == 0 {
+		return LLMResult{}, fmt.Errorf("empty LLM response")
 	}
-	return strings.TrimSuffix(builder.String(), "\n---\n")
+	res.Message = answer.String()
+	res.Reasoning = reasoning.String()
+	return res, nil
 }
 
-func (s *Service) streamCombinedLLM(
+// streamFinal streams the answer of a pipeline's final stage to the client.
+func (s *Service) streamFinal(
 	ctx context.Context,
-	messageID, conversationID string,
-	input string,
-	stream chan<- StatusEvent,
-) error {
-	s.logger.Debug("Combining LLM 3",
-		zap.String("message", input),
-		zap.String("task", "llm-combine"),
-		zap.String("message_id", messageID),
-		zap.String("conversation_id", conversationID))
+	r *run,
+	stage *Stage,
+	task PromptTask,
+) (LLMResult, error) {
+	s.logger.Debug("Streaming final answer", r.logFields(
+		zap.String("task", task.ID),
+		zap.String("template", task.Template),
+		zap.String("stage", stage.ID),
+	)...)
+
+	if !r.emit(ctx, StatusEvent{
+		Status:   Status("Sending to " + task.ID),
+		Source:   task.ID,
+		Template: task.Template,
+		Stage:    stage.ID,
+	}) {
+		return LLMResult{}, ctx.Err()
+	}
 
-	stream <- StatusEvent{
-		MessageID:      messageID,
-		ConversationID: conversationID,
-		Status:         "Combining via LLM 3",
-		Source:         "llm-combine",
+	timeoutErr := &TimeoutError{
+		Source:  task.ID,
+		Timeout: cmp.Or(task.Timeout, r.opts.CombineTimeout, s.timeouts.Combine),
+		Policy:  TimeoutFail,
 	}
+	streamCtx, cancel := withTimeout(ctx, timeoutErr.Timeout, timeoutErr)
+	defer cancel()
 
-	resultStream := s.llm.Stream(ctx, []llm.ChatMessage{
-		{Role: "system", Content: "You are LLM 3. Combine and summarize the following responses:"},
-		{Role: "user", Content: input},
-	})
+	res := LLMResult{ID: task.ID, Template: task.Template, Usage: &llm.Usage{}}
+	var answer strings.Builder
 
-	for res := range resultStream {
+	for chunk, err := range s.llm.Stream(streamCtx, task.Prompt, task.callOptions()...) {
 		if ctx.Err() != nil {
-			s.logger.Warn("Context cancelled during llm.Stream",
-				zap.String("message_id", messageID),
-				zap.String("conversation_id", conversationID),
-			)
-			return ctx.Err()
+			s.logger.Warn("Context cancelled during llm.Stream", r.logFields(zap.String("task", task.ID))...)
+			return LLMResult{}, ctx.Err()
+		}
+		if streamCtx.Err() != nil {
+			s.logger.Warn("Final stage timed out", r.logFields(
+				zap.String("task", task.ID),
+				zap.Duration("timeout", timeoutErr.Timeout),
+			)...)
+			r.emit(ctx, StatusEvent{
+				Status:     StatusTimeout,
+				Source:     task.ID,
+				Template:   task.Template,
+				Stage:      stage.ID,
+				Message:    timeoutErr.explain(),
+				ErrorClass: string(llm.ErrorClassTimeout),
+			})
+			return LLMResult{}, timeoutErr
 		}
-		if res.Err != nil {
-			return res.Err
+		if err != nil {
+			return LLMResult{}, err
 		}
+		res.Usage.Add(chunk.Usage)
 
-		stream <- StatusEvent{
-			MessageID:      messageID,
-			ConversationID: conversationID,
-			Status:         "Streaming",
-			Source:         "llm-combine",
-			Message:        res.Content,
+		if chunk.Reasoning != "" && r.opts.Reasoning == ReasoningForward {
+			if !r.emit(ctx, StatusEvent{
+				Status:   StatusReasoning,
+				Source:   task.ID,
+				Template: task.Template,
+				Stage:    stage.ID,
+				Message:  chunk.Reasoning,
+			}) {
+				return LLMResult{}, ctx.Err()
+			}
+		}
+		if chunk.Content == "" {
+			continue
 		}
-	}
 
-	stream <- StatusEvent{
-		MessageID:      messageID,
-		ConversationID: conversationID,
-		Status:         "Completed",
-		Source:         "llm-combine",
-		Final:          true,
+		answer.WriteString(chunk.Content)
+		if !r.emit(ctx, StatusEvent{
+			Status:   StatusStreaming,
+			Source:   task.ID,
+			Template: task.Template,
+			Stage:    stage.ID,
+			Message:  chunk.Content,
+		}) {
+			return LLMResult{}, ctx.Err()
+		}
 	}
 
-	s.logger.Debug("Completed via LLM 3")
-	return nil
+	res.Message = answer.String()
+	return res, nil
 }
@@ -2,7 +2,12 @@ package service_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -53,3 +58,303 @@ func newTestLogger() *zap.Logger {
 	logger, _ := cfg.Build()
 	return logger
 }
+
+// stubLLM answers Call by system prompt and streams a fixed combined answer,
+// recording the combine input.
+type stubLLM struct {
+	replies map[string]error
+	mu      sync.Mutex
+	combine []llm.ChatMessage
+}
+
+// errBlock makes a stubLLM agent hang until its context ends.
+var errBlock = errors.New("block")
+
+func (s *stubLLM) Call(ctx context.Context, messages []llm.ChatMessage, _ ...llm.Option) (llm.Completion, error) {
+	if err := s.replies[messages[0].Content]; err == errBlock {
+		<-ctx.Done()
+		return llm.Completion{}, ctx.Err()
+	} else if err != nil {
+		return llm.Completion{}, err
+	}
+	return llm.Completion{Content: "answer from " + messages[0].Content}, nil
+}
+
+func (s *stubLLM) Stream(ctx context.Context, messages []llm.ChatMessage, _ ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	s.mu.Lock()
+	s.combine = messages
+	s.mu.Unlock()
+	return func(yield func(llm.Chunk, error) bool) {
+		yield(llm.Chunk{Content: "combined"}, nil)
+	}
+}
+
+func collectEvents(events chan service.StatusEvent) func() []service.StatusEvent {
+	var got []service.StatusEvent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			got = append(got, e)
+		}
+	}()
+	return func() []service.StatusEvent {
+		close(events)
+		<-done
+		return got
+	}
+}
+
+func TestProcessMessage_CompletionPolicy(t *testing.T) {
+	tasks := []service.PromptTask{
+		{ID: "llm-1", Prompt: []llm.ChatMessage{{Role: "system", Content: "agent 1"}, {Role: "user", Content: "q"}}},
+		{ID: "llm-2", Prompt: []llm.ChatMessage{{Role: "system", Content: "agent 2"}, {Role: "user", Content: "q"}}},
+	}
+
+	t.Run("all fails on one error", func(t *testing.T) {
+		stub := &stubLLM{replies: map[string]error{"agent 2": errors.New("boom")}}
+		svc := service.NewService(stub, zap.NewNop())
+
+		eventChan := make(chan service.StatusEvent, 10)
+		wait := collectEvents(eventChan)
+		err := svc.ProcessMessage(context.Background(), "msg-1", "", tasks, eventChan)
+		wait()
+		require.ErrorContains(t, err, "boom")
+	})
+
+	t.Run("quorum continues and names missing agents", func(t *testing.T) {
+		stub := &stubLLM{replies: map[string]error{"agent 2": errors.New("boom")}}
+		svc := service.NewService(stub, zap.NewNop())
+
+		eventChan := make(chan service.StatusEvent, 10)
+		wait := collectEvents(eventChan)
+		err := svc.ProcessMessage(context.Background(), "msg-1", "", tasks, eventChan,
+			service.WithPolicy(service.CompletionPolicy{Mode: service.PolicyQuorum, Min: 1}))
+		events := wait()
+		require.NoError(t, err)
+
+		var failed []string
+		for _, e := range events {
+			if e.Status == service.StatusFailed {
+				failed = append(failed, e.Source)
+			}
+		}
+		require.Equal(t, []string{"llm-2"}, failed)
+		require.Contains(t, stub.combine[1].Content, "perspectives of llm-2 are missing")
+		require.Contains(t, stub.combine[1].Content, "answer from agent 1")
+		require.True(t, events[len(events)-1].Final)
+	})
+}
+
+// blockingLLM fails "agent 1" at once and keeps every other agent busy until
+// its context is cancelled.
+type blockingLLM struct {
+	started   atomic.Int32
+	cancelled atomic.Int32
+}
+
+func (b *blockingLLM) Call(ctx context.Context, messages []llm.ChatMessage, _ ...llm.Option) (llm.Completion, error) {
+	if messages[0].Content == "agent 1" {
+		return llm.Completion{}, errors.New("boom")
+	}
+	b.started.Add(1)
+	<-ctx.Done()
+	b.cancelled.Add(1)
+	return llm.Completion{}, ctx.Err()
+}
+
+func (b *blockingLLM) Stream(ctx context.Context, _ []llm.ChatMessage, _ ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	return func(yield func(llm.Chunk, error) bool) {
+		<-ctx.Done()
+		yield(llm.Chunk{}, ctx.Err())
+	}
+}
+
+func agentTasks(n int) []service.PromptTask {
+	tasks := make([]service.PromptTask, n)
+	for i := range tasks {
+		tasks[i] = service.PromptTask{
+			ID:     fmt.Sprintf("llm-%d", i+1),
+			Prompt: []llm.ChatMessage{{Role: "system", Content: fmt.Sprintf("agent %d", i+1)}, {Role: "user", Content: "q"}},
+		}
+	}
+	return tasks
+}
+
+// requireNoLeaks waits for the goroutine count to drop back to baseline and
+// dumps the remaining stacks if it doesn't.
+func requireNoLeaks(t *testing.T, baseline int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("leaked %d goroutines:\n%s", runtime.NumGoroutine()-baseline, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessMessage_FailFastCancelsSiblings(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	stub := &blockingLLM{}
+	svc := service.NewService(stub, zap.NewNop())
+
+	eventChan := make(chan service.StatusEvent, 10)
+	wait := collectEvents(eventChan)
+
+	err := svc.ProcessMessage(context.Background(), "msg-1", "", agentTasks(3), eventChan)
+	wait()
+	require.ErrorContains(t, err, "boom")
+
+	// Every sibling that got as far as calling the LLM was cancelled and had
+	// returned before ProcessMessage did
+	require.Equal(t, stub.started.Load(), stub.cancelled.Load())
+	requireNoLeaks(t, baseline)
+}
+
+func TestProcessMessage_NoLeakWhenReaderStops(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	svc := service.NewService(&blockingLLM{}, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Unbuffered like the HTTP handler; read one event, then walk away the way
+	// the handler does when the client disconnects
+	eventChan := make(chan service.StatusEvent)
+	go func() {
+		<-eventChan
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.ProcessMessage(ctx, "msg-1", "", agentTasks(3), eventChan,
+			service.WithPolicy(service.CompletionPolicy{Mode: service.PolicyBestEffort, Min: 1}))
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ProcessMessage blocked after the reader stopped")
+	}
+	requireNoLeaks(t, baseline)
+}
+
+func TestProcessMessage_AgentTimeout(t *testing.T) {
+	run := func(t *testing.T, onTimeout service.TimeoutPolicy) (*stubLLM, []service.StatusEvent, error) {
+		stub := &stubLLM{replies: map[string]error{"agent 2": errBlock}}
+		svc := service.NewService(stub, zap.NewNop())
+
+		tasks := agentTasks(2)
+		tasks[1].Timeout = 50 * time.Millisecond
+		tasks[1].OnTimeout = onTimeout
+		tasks[1].Fallback = "no answer from the fact checker"
+
+		eventChan := make(chan service.StatusEvent, 10)
+		wait := collectEvents(eventChan)
+		err := svc.ProcessMessage(context.Background(), "msg-1", "", tasks, eventChan)
+		return stub, wait(), err
+	}
+
+	timeoutEvent := func(t *testing.T, events []service.StatusEvent) service.StatusEvent {
+		for _, e := range events {
+			if e.Status == service.StatusTimeout {
+				return e
+			}
+		}
+		t.Fatal("no Timeout event")
+		return service.StatusEvent{}
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		stub, events, err := run(t, service.TimeoutSkip)
+		require.NoError(t, err)
+		require.Equal(t, "llm-2", timeoutEvent(t, events).Source)
+		require.Contains(t, timeoutEvent(t, events).Message, "continuing without it")
+		require.Contains(t, stub.combine[1].Content, "perspectives of llm-2 are missing because those agents did not answer")
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		stub, events, err := run(t, service.TimeoutFallback)
+		require.NoError(t, err)
+		require.Contains(t, timeoutEvent(t, events).Message, "fallback")
+		require.Contains(t, stub.combine[1].Content, "no answer from the fact checker")
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		_, events, err := run(t, service.TimeoutFail)
+		var timeoutErr *service.TimeoutError
+		require.ErrorAs(t, err, &timeoutErr)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Contains(t, timeoutEvent(t, events).Message, "failing the request")
+	})
+}
+
+func TestProcessMessage_SchemaFallback(t *testing.T) {
+	schema := llm.MustSchema("score", `{"type": "object", "required": ["score"], "properties": {"score": {"type": "number"}}}`)
+	run := func(t *testing.T, fallback string) (any, error) {
+		svc := service.NewService(&stubLLM{replies: map[string]error{"agent 2": errBlock}}, zap.NewNop())
+		task := agentTasks(2)[1]
+		task.Schema = schema
+		task.Timeout = 50 * time.Millisecond
+		task.OnTimeout = service.TimeoutFallback
+		task.Fallback = fallback
+
+		var value any
+		p := &service.Pipeline{
+			Name: "scored",
+			Stages: []service.Stage{
+				{ID: "score", Tasks: service.StaticTasks(task)},
+				{ID: "answer", DependsOn: []string{"score"}, Final: true, Tasks: func(in service.StageInput) ([]service.PromptTask, error) {
+					value = in.Outputs["score"].Results[0].Value
+					return agentTasks(1), nil
+				}},
+			},
+		}
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err := svc.RunPipeline(context.Background(), "msg-1", "", "q", p, eventChan)
+		wait()
+		return value, err
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		value, err := run(t, `{"score": 0}`)
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{"score": 0.0}, value)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := run(t, "no score")
+		require.ErrorContains(t, err, "llm-2 fallback answer")
+	})
+}
+
+func TestProcessMessage_StreamAgents(t *testing.T) {
+	mock := &llm.MockClient{Chunks: []string{"to", "ken"}}
+	svc := service.NewService(mock, zap.NewNop(), service.WithAgentStreaming(true))
+
+	run := func(opts ...service.ProcessOption) map[string]string {
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err := svc.ProcessMessage(context.Background(), "msg-1", "", agentTasks(2), eventChan, opts...)
+		events := wait()
+		require.NoError(t, err)
+
+		streamed := map[string]string{}
+		for _, e := range events {
+			if e.Status == service.StatusAgentStreaming {
+				streamed[e.Source] += e.Message
+			}
+		}
+		return streamed
+	}
+
+	require.Equal(t, map[string]string{"llm-1": "token", "llm-2": "token"}, run())
+	require.Empty(t, run(service.WithStreamAgents(false)))
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+)
+
+// TaskTemplate describes a task whose prompts are rendered against the stage
+// input. Each prompt is either a template of its own or the ID of one in the
+// request's prompt registry, which is resolved when the stage runs.
+type TaskTemplate struct {
+	ID       string
+	System   *prompt.Template
+	SystemID string
+	// Prompt is the user message; with neither set it is the user's message.
+	Prompt      *prompt.Template
+	PromptID    string
+	Schema      *llm.Schema
+	Model       string
+	Temperature *float64
+	MaxTokens   int
+	Timeout     time.Duration
+	OnTimeout   TimeoutPolicy
+	Fallback    string
+}
+
+func (in StageInput) templateData() prompt.Data {
+	data := prompt.Data{
+		Message: in.Message,
+		History: in.History,
+		Locale:  in.Locale,
+		Outputs: make(map[string]string, len(in.Outputs)),
+		Results: make(map[string]string),
+		Inputs:  in.Combined(),
+	}
+	for id, out := range in.Outputs {
+		data.Outputs[id] = out.Text
+		for _, res := range out.Results {
+			if res.Err == nil {
+				data.Results[res.ID] = res.Message
+			}
+		}
+	}
+	return data
+}
+
+// resolve returns t, or the template called id in the request's registry.
+func (in StageInput) resolve(t *prompt.Template, id string) (*prompt.Template, error) {
+	if t != nil || id == "" {
+		return t, nil
+	}
+	return in.prompts.Get(id)
+}
+
+// TemplateTasks returns a Tasks function rendering specs for each stage
+// input. The tasks record the versions of the templates they came from.
+func TemplateTasks(specs ...TaskTemplate) func(StageInput) ([]PromptTask, error) {
+	return func(in StageInput) ([]PromptTask, error) {
+		data := in.templateData()
+		tasks := make([]PromptTask, 0, len(specs))
+		for _, spec := range specs {
+			var refs []string
+			render := func(t *prompt.Template, id, fallback string) (string, error) {
+				t, err := in.resolve(t, id)
+				if err != nil || t == nil {
+					return fallback, err
+				}
+				refs = append(refs, t.Ref())
+				return t.Render(data)
+			}
+
+			system, err := render(spec.System, spec.SystemID, "")
+			if err != nil {
+				return nil, err
+			}
+			user, err := render(spec.Prompt, spec.PromptID, in.Message)
+			if err != nil {
+				return nil, err
+			}
+
+			tasks = append(tasks, PromptTask{
+				ID:          spec.ID,
+				Prompt:      in.messages(system, user),
+				Template:    joinRefs(refs...),
+				Schema:      spec.Schema,
+				Model:       spec.Model,
+				Temperature: spec.Temperature,
+				MaxTokens:   spec.MaxTokens,
+				Timeout:     spec.Timeout,
+				OnTimeout:   spec.OnTimeout,
+				Fallback:    spec.Fallback,
+			})
+		}
+		return tasks, nil
+	}
+}
+
+// joinRefs lists the non-empty template refs behind a task.
+func joinRefs(refs ...string) string {
+	return strings.Join(slices.DeleteFunc(refs, func(ref string) bool { return ref == "" }), ",")
+}
+
+func (in StageInput) messages(system, user string) []llm.ChatMessage {
+	return chatMessages(system, in.History, user)
+}
+
+// chatMessages puts the earlier turns of the conversation between the
+// system prompt and the current user message.
+func chatMessages(system string, history []prompt.Turn, user string) []llm.ChatMessage {
+	var messages []llm.ChatMessage
+	if system != "" {
+		messages = append(messages, llm.ChatMessage{Role: "system", Content: system})
+	}
+	for _, turn := range history {
+		messages = append(messages,
+			llm.ChatMessage{Role: "user", Content: turn.User},
+			llm.ChatMessage{Role: "assistant", Content: turn.Assistant},
+		)
+	}
+	return append(messages, llm.ChatMessage{Role: "user", Content: user})
+}
+
+// WhenTemplate returns a stage condition that holds when t renders to
+// anything but blank or "false". A condition that fails to render is false.
+func WhenTemplate(t *prompt.Template) func(StageInput) bool {
+	return func(in StageInput) bool {
+		out, err := t.Render(in.templateData())
+		if err != nil {
+			return false
+		}
+		out = strings.TrimSpace(out)
+		return out != "" && out != "false"
+	}
+}
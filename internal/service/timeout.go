@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TimeoutPolicy decides what an agent overrunning its timeout means for the
+// request.
+type TimeoutPolicy string
+
+const (
+	// TimeoutSkip drops the agent; it is reported as a missing perspective
+	// but doesn't count against the completion policy.
+	TimeoutSkip TimeoutPolicy = "skip"
+	// TimeoutFail fails the whole request.
+	TimeoutFail TimeoutPolicy = "fail"
+	// TimeoutFallback uses the task's Fallback text as its answer.
+	TimeoutFallback TimeoutPolicy = "fallback"
+)
+
+// ParseTimeoutPolicy validates a policy name from configuration.
+func ParseTimeoutPolicy(s string) (TimeoutPolicy, error) {
+	switch p := TimeoutPolicy(s); p {
+	case "":
+		return TimeoutSkip, nil
+	case TimeoutSkip, TimeoutFail, TimeoutFallback:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown timeout policy %q", s)
+	}
+}
+
+// Timeouts are the service-wide defaults. Zero durations mean no limit beyond
+// the request's own deadline.
+type Timeouts struct {
+	Agent     time.Duration
+	OnTimeout TimeoutPolicy
+	Combine   time.Duration
+}
+
+// TimeoutError reports a stage that ran past its own deadline, as opposed to
+// the request being cancelled.
+type TimeoutError struct {
+	Source  string
+	Timeout time.Duration
+	Policy  TimeoutPolicy
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s did not answer within %s", e.Source, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// explain describes the outcome for the client.
+func (e *TimeoutError) explain() string {
+	switch e.Policy {
+	case TimeoutFail:
+		return e.Error() + "; failing the request"
+	case TimeoutFallback:
+		return e.Error() + "; using its fallback answer"
+	default:
+		return e.Error() + "; continuing without it"
+	}
+}
+
+// withTimeout derives a context that expires after d with a TimeoutError as
+// its cause. A zero d returns ctx unchanged.
+func withTimeout(ctx context.Context, d time.Duration, timeoutErr *TimeoutError) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, d, timeoutErr)
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+
+	"go.uber.org/zap"
+)
+
+const StatusVoted Status = "Voted"
+
+// Equivalence decides when two sampled answers count as the same vote.
+type Equivalence string
+
+const (
+	// EquivalenceExact compares extracted answers byte for byte.
+	EquivalenceExact Equivalence = "exact"
+	// EquivalenceNormalized ignores case, punctuation and spacing.
+	EquivalenceNormalized Equivalence = "normalized"
+	// EquivalenceLLM asks the model to group answers that mean the same.
+	EquivalenceLLM Equivalence = "llm"
+)
+
+func ParseEquivalence(s string) (Equivalence, error) {
+	switch e := Equivalence(s); e {
+	case "":
+		return EquivalenceNormalized, nil
+	case EquivalenceExact, EquivalenceNormalized, EquivalenceLLM:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown equivalence %q", s)
+	}
+}
+
+// Vote samples every task of a stage several times and keeps the majority
+// answer (self-consistency).
+type Vote struct {
+	Samples int
+	// Temperature is used for every sample; zero means 1.0.
+	Temperature float64
+	Equivalence Equivalence
+}
+
+// VoteSummary reports how a vote went.
+type VoteSummary struct {
+	Winner string `json:"winner"`
+	Votes  int    `json:"votes"`
+	// Samples counts the samples that answered; failed ones don't vote
+	Samples int     `json:"samples"`
+	Share   float64 `json:"share"`
+	// Distinct is the number of different answers among the samples
+	Distinct int `json:"distinct"`
+}
+
+var answerLine = regexp.MustCompile(`(?im)^\s*(?:final answer|answer)\s*:\s*(.+?)\s*$`)
+
+// extractAnswer returns the comparable part of a sample: its decoded value
+// for structured output, the last "Answer:" line if there is one, or the
+// whole text.
+func extractAnswer(res LLMResult) string {
+	if res.Value != nil {
+		b, err := json.Marshal(res.Value)
+		if err == nil {
+			return string(b)
+		}
+	}
+	if m := answerLine.FindAllStringSubmatch(res.Message, -1); len(m) > 0 {
+		return m[len(m)-1][1]
+	}
+	return strings.TrimSpace(res.Message)
+}
+
+func normalizeAnswer(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+func (s *Service) runVote(ctx context.Context, r *run, st *Stage, tasks []PromptTask) (StageOutput, error) {
+	vote := *st.Vote
+	vote.Samples = max(vote.Samples, 1)
+	temperature := cmp.Or(vote.Temperature, 1.0)
+
+	var samples []PromptTask
+	for _, task := range tasks {
+		for k := range vote.Samples {
+			sample := task
+			sample.ID = fmt.Sprintf("%s#%d", task.ID, k+1)
+			sample.Temperature = &temperature
+			samples = append(samples, sample)
+		}
+	}
+
+	// Samples are redundant by design, so by default any one answering is enough
+	policy := CompletionPolicy{Mode: PolicyBestEffort, Min: 1}
+	if st.Policy != nil {
+		policy = *st.Policy
+	}
+	sampled, err := s.runTasksInParallel(ctx, r, st.ID, samples, r.opts.policy(policy))
+	if err != nil {
+		return StageOutput{}, err
+	}
+
+	usage := &llm.Usage{}
+	results := make([]LLMResult, len(tasks))
+	for i, task := range tasks {
+		res, summary, err := s.tally(ctx, r, task, vote, sampled[i*vote.Samples:(i+1)*vote.Samples], usage)
+		if err != nil {
+			return StageOutput{}, fmt.Errorf("%s vote: %w", task.ID, err)
+		}
+		results[i] = res
+		if res.Err != nil {
+			continue
+		}
+
+		s.logger.Debug("Vote tallied", r.logFields(
+			zap.String("task", task.ID),
+			zap.Int("votes", summary.Votes),
+			zap.Int("samples", summary.Samples),
+		)...)
+		if !r.emit(ctx, StatusEvent{
+			Status:  StatusVoted,
+			Source:  task.ID,
+			Stage:   st.ID,
+			Message: summary.Winner,
+			Votes:   summary,
+		}) {
+			return StageOutput{}, ctx.Err()
+		}
+	}
+
+	return stageOutput(st.ID, results, usage), nil
+}
+
+// tally groups the answered samples by equivalence and returns the first
+// sample of the largest group as the task's result. Ties go to the group
+// whose first sample came earliest.
+func (s *Service) tally(
+	ctx context.Context,
+	r *run,
+	task PromptTask,
+	vote Vote,
+	samples []LLMResult,
+	usage *llm.Usage,
+) (LLMResult, *VoteSummary, error) {
+	var answered []LLMResult
+	var firstErr error
+	for _, res := range samples {
+		usage.Add(res.Usage)
+		if res.Err != nil {
+			firstErr = cmp.Or(firstErr, res.Err)
+			continue
+		}
+		answered = append(answered, res)
+	}
+	if len(answered) == 0 {
+		return LLMResult{ID: task.ID, Err: firstErr}, nil, nil
+	}
+
+	answers := make([]string, len(answered))
+	for i, res := range answered {
+		answers[i] = extractAnswer(res)
+	}
+
+	groups, err := s.group(ctx, r, task, vote.Equivalence, answers, usage)
+	if err != nil {
+		return LLMResult{}, nil, err
+	}
+
+	counts := make(map[int]int)
+	for _, g := range groups {
+		counts[g]++
+	}
+	first := 0
+	for i, g := range groups {
+		if counts[g] > counts[groups[first]] {
+			first = i
+		}
+	}
+	winner := groups[first]
+
+	res := answered[first]
+	res.ID = task.ID
+	res.Usage = nil
+	return res, &VoteSummary{
+		Winner:   answers[first],
+		Votes:    counts[winner],
+		Samples:  len(answered),
+		Share:    float64(counts[winner]) / float64(len(answered)),
+		Distinct: len(counts),
+	}, nil
+}
+
+// group assigns each answer a group number; equal numbers are one vote.
+func (s *Service) group(
+	ctx context.Context,
+	r *run,
+	task PromptTask,
+	equivalence Equivalence,
+	answers []string,
+	usage *llm.Usage,
+) ([]int, error) {
+	key := func(a string) string { return a }
+	if equivalence != EquivalenceExact {
+		key = normalizeAnswer
+	}
+
+	groups := make([]int, len(answers))
+	index := make(map[string]int)
+	var distinct []string
+	for i, a := range answers {
+		k := key(a)
+		g, ok := index[k]
+		if !ok {
+			g = len(distinct)
+			index[k] = g
+			distinct = append(distinct, a)
+		}
+		groups[i] = g
+	}
+	if equivalence != EquivalenceLLM || len(distinct) < 2 {
+		return groups, nil
+	}
+
+	merged, err := s.llmGroups(ctx, r, task, distinct, usage)
+	if err != nil {
+		return nil, err
+	}
+	for i, g := range groups {
+		groups[i] = merged[g]
+	}
+	return groups, nil
+}
+
+var groupsSchema = llm.MustSchema("answer_groups", `{
+	"type": "object",
+	"properties": {
+		"groups": {"type": "array", "items": {"type": "array", "items": {"type": "integer", "minimum": 1}}}
+	},
+	"required": ["groups"],
+	"additionalProperties": false
+}`)
+
+// llmGroups asks the model which of the distinct answers mean the same and
+// maps each to the first answer of its group. Answers the model leaves out
+// stay on their own.
+func (s *Service) llmGroups(ctx context.Context, r *run, task PromptTask, distinct []string, usage *llm.Usage) ([]int, error) {
+	t, err := r.prompts.Get(prompt.VoteEquivalence)
+	if err != nil {
+		return nil, err
+	}
+	system, err := t.Render(prompt.Data{Locale: r.opts.Locale})
+	if err != nil {
+		return nil, err
+	}
+
+	var list strings.Builder
+	for i, a := range distinct {
+		fmt.Fprintf(&list, "%d. %s\n", i+1, a)
+	}
+
+	res, err := s.callTask(ctx, PromptTask{
+		ID:       task.ID + "-equivalence",
+		Template: t.Ref(),
+		Schema:   groupsSchema,
+		Prompt: []llm.ChatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: list.String()},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage.Add(res.Usage)
+	s.logger.Debug("Grouped vote answers", r.logFields(
+		zap.String("task", task.ID),
+		zap.String("template", t.Ref()),
+		zap.Int("distinct", len(distinct)),
+	)...)
+
+	var out struct {
+		Groups [][]int `json:"groups"`
+	}
+	if err := res.Decode(&out); err != nil {
+		return nil, err
+	}
+
+	merged := make([]int, len(distinct))
+	for i := range merged {
+		merged[i] = -1
+	}
+	for _, group := range out.Groups {
+		leader := -1
+		for _, n := range group {
+			i := n - 1
+			if i < 0 || i >= len(distinct) || merged[i] >= 0 {
+				continue
+			}
+			if leader < 0 {
+				leader = i
+			}
+			merged[i] = leader
+		}
+	}
+	for i := range merged {
+		if merged[i] < 0 {
+			merged[i] = i
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,81 @@
+package service_test
+
+import (
+	"context"
+	"iter"
+	"sync/atomic"
+	"testing"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// sampleLLM returns its answers in turn, one per call.
+type sampleLLM struct {
+	answers []string
+	calls   atomic.Int32
+}
+
+func (s *sampleLLM) Call(context.Context, []llm.ChatMessage, ...llm.Option) (llm.Completion, error) {
+	n := int(s.calls.Add(1)) - 1
+	return llm.Completion{Content: "Thinking...\nAnswer: " + s.answers[n%len(s.answers)]}, nil
+}
+
+func (s *sampleLLM) Stream(context.Context, []llm.ChatMessage, ...llm.Option) iter.Seq2[llm.Chunk, error] {
+	return func(yield func(llm.Chunk, error) bool) {}
+}
+
+func TestRunPipeline_Vote(t *testing.T) {
+	concat, err := service.ParseCombiner(service.CombineConcat)
+	require.NoError(t, err)
+
+	run := func(t *testing.T, equivalence service.Equivalence) *service.VoteSummary {
+		stub := &sampleLLM{answers: []string{"Paris", "Lyon", "paris.", "Paris"}}
+		svc := service.NewService(stub, zap.NewNop())
+		p := &service.Pipeline{
+			Name: "vote",
+			Stages: []service.Stage{
+				{
+					ID:    "solve",
+					Tasks: service.StaticTasks(agentTasks(1)...),
+					Vote:  &service.Vote{Samples: 4, Equivalence: equivalence},
+				},
+				service.CombineStage("answer", concat, "solve"),
+			},
+		}
+
+		eventChan := make(chan service.StatusEvent, 32)
+		wait := collectEvents(eventChan)
+		err := svc.RunPipeline(context.Background(), "msg-1", "", "capital of France?", p, eventChan)
+		events := wait()
+		require.NoError(t, err)
+		require.EqualValues(t, 4, stub.calls.Load())
+
+		for _, e := range events {
+			if e.Status == service.StatusVoted {
+				require.Equal(t, "llm-1", e.Source)
+				return e.Votes
+			}
+		}
+		t.Fatal("no Voted event")
+		return nil
+	}
+
+	t.Run("normalized merges case and punctuation", func(t *testing.T) {
+		votes := run(t, service.EquivalenceNormalized)
+		require.Equal(t, 2, votes.Distinct)
+		require.Equal(t, 3, votes.Votes)
+		require.Equal(t, 0.75, votes.Share)
+		require.Contains(t, []string{"Paris", "paris."}, votes.Winner)
+	})
+
+	t.Run("exact keeps variants apart", func(t *testing.T) {
+		votes := run(t, service.EquivalenceExact)
+		require.Equal(t, 3, votes.Distinct)
+		require.Equal(t, "Paris", votes.Winner)
+		require.Equal(t, 2, votes.Votes)
+	})
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"slices"
+	"sync"
+
+	"llmsse/internal/prompt"
+)
+
+// Memory keeps everything in process and is lost on restart, so it suits
+// tests and development. With a limit it keeps the messages of that many
+// conversations, counting each message outside a conversation as one, and
+// forgets the least recently updated beyond it.
+type Memory struct {
+	limit int
+
+	mu            sync.RWMutex
+	messages      map[string]Message
+	conversations map[string]*Conversation
+	// order lists the message IDs of each conversation, oldest first
+	order map[string][]string
+	// recent holds a memoryKey per conversation and per message outside
+	// one, most recently updated first
+	recent *list.List
+	keys   map[memoryKey]*list.Element
+}
+
+type memoryKey struct {
+	conversationID, messageID string
+}
+
+// NewMemory returns a Memory that keeps up to limit conversations, or
+// everything when limit is 0.
+func NewMemory(limit int) *Memory {
+	return &Memory{
+		limit:         limit,
+		messages:      make(map[string]Message),
+		conversations: make(map[string]*Conversation),
+		order:         make(map[string][]string),
+		recent:        list.New(),
+		keys:          make(map[memoryKey]*list.Element),
+	}
+}
+
+func (m *Memory) SaveMessage(_ context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg.Outputs = slices.Clone(msg.Outputs)
+	_, exists := m.messages[msg.ID]
+	m.messages[msg.ID] = msg
+	if msg.ConversationID == "" {
+		m.touch(memoryKey{messageID: msg.ID})
+		return nil
+	}
+
+	c, ok := m.conversations[msg.ConversationID]
+	if !ok {
+		c = &Conversation{ID: msg.ConversationID, CreatedAt: msg.CreatedAt}
+		m.conversations[msg.ConversationID] = c
+	}
+	if t := msg.updatedAt(); t.After(c.UpdatedAt) {
+		c.UpdatedAt = t
+	}
+	if !exists {
+		m.order[msg.ConversationID] = append(m.order[msg.ConversationID], msg.ID)
+		c.Messages++
+	}
+	m.touch(memoryKey{conversationID: msg.ConversationID})
+	return nil
+}
+
+// touch marks k as the most recently updated and forgets the least recently
+// updated beyond the limit; m.mu must be held.
+func (m *Memory) touch(k memoryKey) {
+	if e, ok := m.keys[k]; ok {
+		m.recent.MoveToFront(e)
+	} else {
+		m.keys[k] = m.recent.PushFront(k)
+	}
+	for m.limit > 0 && m.recent.Len() > m.limit {
+		m.forget(m.recent.Remove(m.recent.Back()).(memoryKey))
+	}
+}
+
+// forget drops a conversation with its messages, or a message outside one;
+// m.mu must be held.
+func (m *Memory) forget(k memoryKey) {
+	delete(m.keys, k)
+	if k.conversationID == "" {
+		delete(m.messages, k.messageID)
+		return
+	}
+	for _, id := range m.order[k.conversationID] {
+		delete(m.messages, id)
+	}
+	delete(m.order, k.conversationID)
+	delete(m.conversations, k.conversationID)
+}
+
+func (m *Memory) Message(_ context.Context, id string) (Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	msg, ok := m.messages[id]
+	if !ok {
+		return Message{}, ErrNotFound
+	}
+	msg.Outputs = slices.Clone(msg.Outputs)
+	return msg, nil
+}
+
+func (m *Memory) Messages(_ context.Context, conversationID string) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := m.order[conversationID]
+	out := make([]Message, 0, len(ids))
+	for _, id := range ids {
+		msg := m.messages[id]
+		msg.Outputs = slices.Clone(msg.Outputs)
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+func (m *Memory) Conversation(_ context.Context, id string) (Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.conversations[id]
+	if !ok {
+		return Conversation{}, ErrNotFound
+	}
+	return *c, nil
+}
+
+func (m *Memory) Conversations(_ context.Context, limit, offset int) ([]Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]Conversation, 0, len(m.conversations))
+	for _, c := range m.conversations {
+		out = append(out, *c)
+	}
+	slices.SortFunc(out, func(a, b Conversation) int {
+		return cmp.Or(b.UpdatedAt.Compare(a.UpdatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	out = out[min(offset, len(out)):]
+	return out[:min(limit, len(out))], nil
+}
+
+func (m *Memory) History(_ context.Context, conversationID string, n int) ([]prompt.Turn, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var turns []prompt.Turn
+	ids := m.order[conversationID]
+	for i := len(ids) - 1; i >= 0 && len(turns) < n; i-- {
+		if msg := m.messages[ids[i]]; msg.Status == StatusCompleted {
+			turns = append(turns, prompt.Turn{User: msg.Content, Assistant: msg.Answer})
+		}
+	}
+	slices.Reverse(turns)
+	return turns, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
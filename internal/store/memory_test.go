@@ -0,0 +1,42 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory_Limit(t *testing.T) {
+	ctx := context.Background()
+	m := store.NewMemory(2)
+	save := func(id, conversationID string) {
+		t.Helper()
+		require.NoError(t, m.SaveMessage(ctx, store.Message{ID: id, ConversationID: conversationID, Status: store.StatusCompleted}))
+	}
+
+	save("a-1", "conv-a")
+	save("b-1", "conv-b")
+	save("a-2", "conv-a")
+	// conv-b is now the least recently updated and goes first
+	save("c-1", "conv-c")
+
+	_, err := m.Conversation(ctx, "conv-b")
+	require.ErrorIs(t, err, store.ErrNotFound)
+	_, err = m.Message(ctx, "b-1")
+	require.ErrorIs(t, err, store.ErrNotFound)
+	msgs, err := m.Messages(ctx, "conv-a")
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	// A message outside any conversation counts as one of its own
+	save("lone", "")
+	_, err = m.Conversation(ctx, "conv-a")
+	require.ErrorIs(t, err, store.ErrNotFound)
+	_, err = m.Message(ctx, "lone")
+	require.NoError(t, err)
+	_, err = m.Message(ctx, "c-1")
+	require.NoError(t, err)
+}
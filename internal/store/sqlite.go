@@ -0,0 +1,339 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"llmsse/internal/prompt"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, each once; append new ones, never edit
+// old ones.
+var migrations = []string{
+	`CREATE TABLE conversations (
+		id         TEXT PRIMARY KEY,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE messages (
+		id                TEXT PRIMARY KEY,
+		conversation_id   TEXT REFERENCES conversations (id),
+		pipeline          TEXT NOT NULL,
+		content           TEXT NOT NULL,
+		answer            TEXT NOT NULL,
+		status            TEXT NOT NULL,
+		error             TEXT NOT NULL,
+		prompt_tokens     INTEGER NOT NULL,
+		completion_tokens INTEGER NOT NULL,
+		total_tokens      INTEGER NOT NULL,
+		reasoning_tokens  INTEGER NOT NULL,
+		created_at        INTEGER NOT NULL,
+		completed_at      INTEGER
+	);
+	CREATE INDEX messages_conversation ON messages (conversation_id, created_at);
+	CREATE TABLE outputs (
+		message_id        TEXT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		seq               INTEGER NOT NULL,
+		stage             TEXT NOT NULL,
+		agent             TEXT NOT NULL,
+		template          TEXT NOT NULL,
+		content           TEXT NOT NULL,
+		error             TEXT NOT NULL,
+		prompt_tokens     INTEGER NOT NULL,
+		completion_tokens INTEGER NOT NULL,
+		total_tokens      INTEGER NOT NULL,
+		reasoning_tokens  INTEGER NOT NULL,
+		PRIMARY KEY (message_id, seq)
+	);`,
+	`ALTER TABLE messages ADD COLUMN request_hash TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE messages ADD COLUMN error_class TEXT NOT NULL DEFAULT '';
+	ALTER TABLE outputs ADD COLUMN error_class TEXT NOT NULL DEFAULT '';`,
+}
+
+// SQLite stores everything in one embedded database file.
+type SQLite struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens or creates the database at path and migrates it to the
+// current schema.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	// SQLite allows one writer; a single connection keeps writes from failing
+	// with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate %s: %w", path, err)
+	}
+	return &SQLite{db: db}, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build's %d", current, len(migrations))
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		err := withTx(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func withTx(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) SaveMessage(ctx context.Context, m Message) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var conversationID sql.NullString
+		if m.ConversationID != "" {
+			conversationID = sql.NullString{String: m.ConversationID, Valid: true}
+			updated := m.updatedAt().UnixNano()
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO conversations (id, created_at, updated_at) VALUES (?, ?, ?)
+				ON CONFLICT (id) DO UPDATE SET updated_at = MAX(updated_at, excluded.updated_at)`,
+				m.ConversationID, m.CreatedAt.UnixNano(), updated,
+			); err != nil {
+				return err
+			}
+		}
+
+		var completedAt sql.NullInt64
+		if m.CompletedAt != nil {
+			completedAt = sql.NullInt64{Int64: m.CompletedAt.UnixNano(), Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO messages (id, conversation_id, pipeline, content, answer, status, error,
+				prompt_tokens, completion_tokens, total_tokens, reasoning_tokens, created_at, completed_at,
+				request_hash, error_class)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				conversation_id = excluded.conversation_id, pipeline = excluded.pipeline,
+				content = excluded.content, answer = excluded.answer, status = excluded.status,
+				error = excluded.error, prompt_tokens = excluded.prompt_tokens,
+				completion_tokens = excluded.completion_tokens, total_tokens = excluded.total_tokens,
+				reasoning_tokens = excluded.reasoning_tokens, created_at = excluded.created_at,
+				completed_at = excluded.completed_at, request_hash = excluded.request_hash,
+				error_class = excluded.error_class`,
+			m.ID, conversationID, m.Pipeline, m.Content, m.Answer, m.Status, m.Error,
+			m.Usage.PromptTokens, m.Usage.CompletionTokens, m.Usage.TotalTokens, m.Usage.ReasoningTokens,
+			m.CreatedAt.UnixNano(), completedAt, m.RequestHash, m.ErrorClass,
+		); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM outputs WHERE message_id = ?`, m.ID); err != nil {
+			return err
+		}
+		for i, o := range m.Outputs {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO outputs (message_id, seq, stage, agent, template, content, error,
+					prompt_tokens, completion_tokens, total_tokens, reasoning_tokens, error_class)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				m.ID, i, o.Stage, o.Agent, o.Template, o.Content, o.Error,
+				o.Usage.PromptTokens, o.Usage.CompletionTokens, o.Usage.TotalTokens, o.Usage.ReasoningTokens,
+				o.ErrorClass,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const messageColumns = `id, COALESCE(conversation_id, ''), pipeline, content, answer, status, error,
+	prompt_tokens, completion_tokens, total_tokens, reasoning_tokens, created_at, completed_at, request_hash,
+	error_class`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row scanner) (Message, error) {
+	var m Message
+	var created int64
+	var completed sql.NullInt64
+	err := row.Scan(&m.ID, &m.ConversationID, &m.Pipeline, &m.Content, &m.Answer, &m.Status, &m.Error,
+		&m.Usage.PromptTokens, &m.Usage.CompletionTokens, &m.Usage.TotalTokens, &m.Usage.ReasoningTokens,
+		&created, &completed, &m.RequestHash, &m.ErrorClass)
+	if err != nil {
+		return Message{}, err
+	}
+	m.CreatedAt = time.Unix(0, created)
+	if completed.Valid {
+		t := time.Unix(0, completed.Int64)
+		m.CompletedAt = &t
+	}
+	return m, nil
+}
+
+func (s *SQLite) Message(ctx context.Context, id string) (Message, error) {
+	m, err := scanMessage(s.db.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrNotFound
+	}
+	if err != nil {
+		return Message{}, err
+	}
+	m.Outputs, err = s.outputs(ctx, id)
+	if err != nil {
+		return Message{}, err
+	}
+	return m, nil
+}
+
+func (s *SQLite) outputs(ctx context.Context, messageID string) ([]Output, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT stage, agent, template, content, error,
+			prompt_tokens, completion_tokens, total_tokens, reasoning_tokens, error_class
+		FROM outputs WHERE message_id = ? ORDER BY seq`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Output
+	for rows.Next() {
+		var o Output
+		if err := rows.Scan(&o.Stage, &o.Agent, &o.Template, &o.Content, &o.Error,
+			&o.Usage.PromptTokens, &o.Usage.CompletionTokens, &o.Usage.TotalTokens, &o.Usage.ReasoningTokens,
+			&o.ErrorClass,
+		); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) Messages(ctx context.Context, conversationID string) ([]Message, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages
+		WHERE conversation_id = ? ORDER BY created_at, rowid`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	out := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Outputs are read once the rows are closed, as the store has a single
+	// connection
+	for i := range out {
+		if out[i].Outputs, err = s.outputs(ctx, out[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+const conversationColumns = `c.id, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.id)`
+
+func scanConversation(row scanner) (Conversation, error) {
+	var c Conversation
+	var created, updated int64
+	if err := row.Scan(&c.ID, &created, &updated, &c.Messages); err != nil {
+		return Conversation{}, err
+	}
+	c.CreatedAt, c.UpdatedAt = time.Unix(0, created), time.Unix(0, updated)
+	return c, nil
+}
+
+func (s *SQLite) Conversation(ctx context.Context, id string) (Conversation, error) {
+	c, err := scanConversation(s.db.QueryRowContext(ctx,
+		`SELECT `+conversationColumns+` FROM conversations c WHERE c.id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Conversation{}, ErrNotFound
+	}
+	return c, err
+}
+
+func (s *SQLite) Conversations(ctx context.Context, limit, offset int) ([]Conversation, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+conversationColumns+` FROM conversations c
+		ORDER BY c.updated_at DESC, c.id LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []Conversation{}
+	for rows.Next() {
+		c, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLite) History(ctx context.Context, conversationID string, n int) ([]prompt.Turn, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT content, answer FROM messages
+		WHERE conversation_id = ? AND status = ?
+		ORDER BY created_at DESC, rowid DESC LIMIT ?`, conversationID, StatusCompleted, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var turns []prompt.Turn
+	for rows.Next() {
+		var t prompt.Turn
+		if err := rows.Scan(&t.User, &t.Assistant); err != nil {
+			return nil, err
+		}
+		turns = append(turns, t)
+	}
+	slices.Reverse(turns)
+	return turns, rows.Err()
+}
+
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
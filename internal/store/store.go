@@ -0,0 +1,87 @@
+// Package store persists conversations, their messages and what every agent
+// answered for them.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Status is where a message is in its processing.
+type Status string
+
+const (
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+type Conversation struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Messages  int       `json:"message_count"`
+}
+
+// Message is one request: the user's message, the final answer and the
+// outputs it was combined from.
+type Message struct {
+	ID             string     `json:"id"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	Pipeline       string     `json:"pipeline,omitempty"`
+	Content        string     `json:"content"`
+	Answer         string     `json:"answer,omitempty"`
+	Status         Status     `json:"status"`
+	Error          string     `json:"error,omitempty"`
+	ErrorClass     string     `json:"error_class,omitempty"`
+	Usage          llm.Usage  `json:"usage"`
+	Outputs        []Output   `json:"outputs,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+	// RequestHash identifies the request the message came from, so a retry
+	// can be told apart from a different request reusing its ID
+	RequestHash string `json:"-"`
+}
+
+// updatedAt is when the message last changed its conversation.
+func (m Message) updatedAt() time.Time {
+	if m.CompletedAt != nil {
+		return *m.CompletedAt
+	}
+	return m.CreatedAt
+}
+
+// Output is the answer of one agent in one stage.
+type Output struct {
+	Stage      string    `json:"stage"`
+	Agent      string    `json:"agent"`
+	Template   string    `json:"template,omitempty"`
+	Content    string    `json:"content,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"error_class,omitempty"`
+	Usage      llm.Usage `json:"usage"`
+}
+
+type Store interface {
+	// SaveMessage creates or replaces a message, outputs included, and
+	// creates its conversation on first use.
+	SaveMessage(ctx context.Context, m Message) error
+	Message(ctx context.Context, id string) (Message, error)
+	// Messages returns a conversation's messages, oldest first.
+	Messages(ctx context.Context, conversationID string) ([]Message, error)
+	Conversation(ctx context.Context, id string) (Conversation, error)
+	// Conversations returns up to limit conversations, most recently updated
+	// first, skipping the first offset.
+	Conversations(ctx context.Context, limit, offset int) ([]Conversation, error)
+	// History returns the last n completed turns of a conversation, oldest
+	// first.
+	History(ctx context.Context, conversationID string, n int) ([]prompt.Turn, error)
+	Close() error
+}
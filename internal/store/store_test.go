@@ -0,0 +1,147 @@
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/prompt"
+	"llmsse/internal/store"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.Store{
+		"memory": func(*testing.T) store.Store { return store.NewMemory(0) },
+		"sqlite": func(t *testing.T) store.Store {
+			st, err := store.OpenSQLite(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+			require.NoError(t, err)
+			return st
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			st := open(t)
+			defer st.Close()
+			testStore(t, st)
+		})
+	}
+}
+
+func testStore(t *testing.T, st store.Store) {
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+	at := func(s int) *time.Time {
+		t := start.Add(time.Duration(s) * time.Second)
+		return &t
+	}
+
+	running := store.Message{
+		ID:             "msg-1",
+		ConversationID: "conv-1",
+		Pipeline:       "default",
+		Content:        "first",
+		Status:         store.StatusRunning,
+		CreatedAt:      start,
+		RequestHash:    "abc",
+	}
+	require.NoError(t, st.SaveMessage(ctx, running))
+
+	completed := running
+	completed.Status = store.StatusCompleted
+	completed.Answer = "one"
+	completed.CompletedAt = at(1)
+	completed.Usage = llm.Usage{PromptTokens: 3, CompletionTokens: 4, TotalTokens: 7}
+	completed.Outputs = []store.Output{
+		{Stage: "agents", Agent: "llm-1", Template: "agent.creative@v1", Content: "a", Usage: llm.Usage{TotalTokens: 2}},
+		{Stage: "agents", Agent: "llm-2", Error: "processing failed", ErrorClass: "unknown"},
+	}
+	require.NoError(t, st.SaveMessage(ctx, completed))
+
+	got, err := st.Message(ctx, "msg-1")
+	require.NoError(t, err)
+	require.Equal(t, completed.Outputs, got.Outputs)
+	require.Equal(t, completed.Usage, got.Usage)
+	require.Equal(t, store.StatusCompleted, got.Status)
+	require.True(t, completed.CompletedAt.Equal(*got.CompletedAt))
+	require.Equal(t, "abc", got.RequestHash)
+
+	require.NoError(t, st.SaveMessage(ctx, store.Message{
+		ID: "msg-2", ConversationID: "conv-1", Content: "second", Status: store.StatusFailed,
+		Error: "the request timed out", ErrorClass: "timeout", CreatedAt: *at(2), CompletedAt: at(3),
+	}))
+	require.NoError(t, st.SaveMessage(ctx, store.Message{
+		ID: "msg-3", ConversationID: "conv-1", Content: "third", Answer: "three", Status: store.StatusCompleted,
+		CreatedAt: *at(4), CompletedAt: at(5),
+	}))
+	require.NoError(t, st.SaveMessage(ctx, store.Message{
+		ID: "msg-4", ConversationID: "conv-2", Content: "other", Status: store.StatusRunning, CreatedAt: *at(3),
+	}))
+	require.NoError(t, st.SaveMessage(ctx, store.Message{
+		ID: "msg-5", Content: "no conversation", Status: store.StatusCompleted, CreatedAt: *at(6),
+	}))
+
+	messages, err := st.Messages(ctx, "conv-1")
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	require.Equal(t, "msg-1", messages[0].ID)
+	require.Len(t, messages[0].Outputs, 2)
+	require.Equal(t, "timeout", messages[1].ErrorClass)
+	messages, err = st.Messages(ctx, "missing")
+	require.NoError(t, err)
+	require.NotNil(t, messages, "an empty list, not null")
+	require.Empty(t, messages)
+
+	// Failed messages aren't turns of the conversation
+	history, err := st.History(ctx, "conv-1", 5)
+	require.NoError(t, err)
+	require.Equal(t, []prompt.Turn{{User: "first", Assistant: "one"}, {User: "third", Assistant: "three"}}, history)
+	history, err = st.History(ctx, "conv-1", 1)
+	require.NoError(t, err)
+	require.Equal(t, []prompt.Turn{{User: "third", Assistant: "three"}}, history)
+
+	conv, err := st.Conversation(ctx, "conv-1")
+	require.NoError(t, err)
+	require.Equal(t, 3, conv.Messages)
+	require.True(t, start.Equal(conv.CreatedAt))
+	require.True(t, at(5).Equal(conv.UpdatedAt))
+
+	conversations, err := st.Conversations(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, conversations, 2)
+	require.Equal(t, "conv-1", conversations[0].ID)
+	conversations, err = st.Conversations(ctx, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, conversations, 1)
+	require.Equal(t, "conv-2", conversations[0].ID)
+	conversations, err = st.Conversations(ctx, 10, 5)
+	require.NoError(t, err)
+	require.NotNil(t, conversations, "an empty page, not null")
+	require.Empty(t, conversations)
+
+	_, err = st.Message(ctx, "missing")
+	require.ErrorIs(t, err, store.ErrNotFound)
+	_, err = st.Conversation(ctx, "missing")
+	require.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestOpenSQLite_Reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	st, err := store.OpenSQLite(ctx, path)
+	require.NoError(t, err)
+	require.NoError(t, st.SaveMessage(ctx, store.Message{ID: "msg-1", Content: "hi", Status: store.StatusCompleted}))
+	require.NoError(t, st.Close())
+
+	// Migrations already applied are skipped, and the data survives
+	st, err = store.OpenSQLite(ctx, path)
+	require.NoError(t, err)
+	defer st.Close()
+	got, err := st.Message(ctx, "msg-1")
+	require.NoError(t, err)
+	require.Equal(t, "hi", got.Content)
+}
@@ -0,0 +1,328 @@
+// Package webhook notifies callers when their message has finished, by
+// POSTing a signed payload to a URL they chose.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"llmsse/internal/store"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp, a dot and the body, keyed with the shared secret.
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader is the Unix time the delivery was signed at, so a
+	// receiver can reject replays of old deliveries.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// DeliveryHeader is the same for every attempt of a delivery, so a
+	// receiver can drop duplicates.
+	DeliveryHeader = "X-Webhook-Delivery"
+	EventHeader    = "X-Webhook-Event"
+
+	EventCompleted = "message.completed"
+	EventFailed    = "message.failed"
+	EventCancelled = "message.cancelled"
+)
+
+// Payload is the body of a delivery: the event and the message's final
+// record with its answer, usage and per-agent outputs. Like the record, it
+// only has the sanitized error and error class of a failed message.
+type Payload struct {
+	Event string `json:"event"`
+	store.Message
+}
+
+func NewPayload(m store.Message) Payload {
+	event := EventFailed
+	switch m.Status {
+	case store.StatusCompleted:
+		event = EventCompleted
+	case store.StatusCancelled:
+		event = EventCancelled
+	}
+	return Payload{Event: event, Message: m}
+}
+
+// Sign returns the signature header value for a body sent at timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is valid for a body sent at timestamp.
+func Verify(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// ErrForbiddenAddress is returned for deliveries to addresses that aren't
+// public, such as loopback, private or link-local ones.
+var ErrForbiddenAddress = errors.New("webhook address is not public")
+
+// publicOnly is a net.Dialer Control that refuses to connect to addresses
+// that aren't public, so a webhook_url can't reach the host itself or its
+// network, such as a cloud metadata service. It checks the resolved address,
+// so host names pointing inward are refused as well.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+	return nil
+}
+
+// publicClient is the default client. It goes without a proxy, as its
+// dialer could only check the proxy's address.
+func publicClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: publicOnly}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Sender delivers payloads, retrying failed attempts with exponential
+// backoff. Deliveries that still fail are written to the dead-letter log.
+type Sender struct {
+	secret     []byte
+	client     *http.Client
+	logger     *zap.Logger
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	deadLetter string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// closed is set by Close, after which deliveries fail at once
+	closeMu sync.Mutex
+	closed  bool
+	mu      sync.Mutex
+}
+
+type Option func(*Sender)
+
+// WithClient sets the HTTP client deliveries are sent with. Unlike the
+// default one, it may connect to any address.
+func WithClient(c *http.Client) Option {
+	return func(s *Sender) {
+		s.client = c
+	}
+}
+
+// WithRetries sets how many attempts a delivery gets, and the backoff
+// before the second one, which doubles up to max for each further attempt.
+func WithRetries(attempts int, backoff, max time.Duration) Option {
+	return func(s *Sender) {
+		s.attempts, s.backoff, s.maxBackoff = attempts, backoff, max
+	}
+}
+
+// WithDeadLetterFile appends deliveries that failed for good to path, one
+// JSON object per line. They are logged either way.
+func WithDeadLetterFile(path string) Option {
+	return func(s *Sender) {
+		s.deadLetter = path
+	}
+}
+
+func New(secret string, logger *zap.Logger, opts ...Option) *Sender {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Sender{
+		secret:     []byte(secret),
+		client:     publicClient(),
+		logger:     logger,
+		attempts:   5,
+		backoff:    time.Second,
+		maxBackoff: time.Minute,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// DeadLetter is a delivery that failed for good.
+type DeadLetter struct {
+	URL        string    `json:"url"`
+	DeliveryID string    `json:"delivery_id"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error"`
+	FailedAt   time.Time `json:"failed_at"`
+	Payload    Payload   `json:"payload"`
+}
+
+// Deliver sends p to url in the background. Once the sender is closed, p
+// is dead-lettered instead.
+func (s *Sender) Deliver(url string, p Payload) {
+	s.closeMu.Lock()
+	closed := s.closed
+	if !closed {
+		s.wg.Add(1)
+	}
+	s.closeMu.Unlock()
+	if closed {
+		s.Send(s.ctx, url, p)
+		return
+	}
+
+	go func() {
+		defer s.wg.Done()
+		s.Send(s.ctx, url, p)
+	}()
+}
+
+// Send delivers p to url, retrying until it is accepted, the attempts run
+// out or ctx is done. A failed delivery is dead-lettered and its error
+// returned.
+func (s *Sender) Send(ctx context.Context, url string, p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encode webhook payload: %w", err)
+	}
+	id := rand.Text()
+
+	log := s.logger.With(
+		zap.String("url", url),
+		zap.String("delivery_id", id),
+		zap.String("message_id", p.ID),
+		zap.String("event", p.Event),
+	)
+
+	var attempt int
+	backoff := s.backoff
+	for {
+		attempt++
+		retry, err := s.attempt(ctx, url, id, p.Event, body)
+		if err == nil {
+			log.Debug("Webhook delivered", zap.Int("attempt", attempt))
+			return nil
+		}
+		if !retry || attempt >= s.attempts {
+			s.deadLetterFor(log, DeadLetter{
+				URL: url, DeliveryID: id, Attempts: attempt, Error: err.Error(), FailedAt: time.Now(), Payload: p,
+			})
+			return err
+		}
+
+		log.Warn("Webhook delivery failed, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			s.deadLetterFor(log, DeadLetter{
+				URL: url, DeliveryID: id, Attempts: attempt, Error: err.Error(), FailedAt: time.Now(), Payload: p,
+			})
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, s.maxBackoff)
+	}
+}
+
+// attempt POSTs body once and reports whether a failure is worth retrying.
+func (s *Sender) attempt(ctx context.Context, url, id, event string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(DeliveryHeader, id)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(s.secret, timestamp, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return !errors.Is(err, ErrForbiddenAddress), err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("receiver answered %s", res.Status)
+	default:
+		// The receiver rejected the payload; sending it again won't help
+		return false, fmt.Errorf("receiver answered %s", res.Status)
+	}
+}
+
+func (s *Sender) deadLetterFor(log *zap.Logger, dl DeadLetter) {
+	log.Error("Webhook delivery failed for good",
+		zap.Int("attempts", dl.Attempts),
+		zap.String("error", dl.Error),
+	)
+	if s.deadLetter == "" {
+		return
+	}
+
+	line, err := json.Marshal(dl)
+	if err != nil {
+		log.Error("Failed to encode dead letter", zap.Error(err))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Error("Failed to open dead-letter log", zap.Error(err))
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Error("Failed to write dead letter", zap.Error(err))
+	}
+}
+
+// Close stops retrying, dead-letters the deliveries still pending and waits
+// for them.
+func (s *Sender) Close() {
+	s.closeMu.Lock()
+	s.closed = true
+	s.closeMu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+}
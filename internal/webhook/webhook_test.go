@@ -0,0 +1,165 @@
+package webhook_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"llmsse/internal/llm"
+	"llmsse/internal/store"
+	"llmsse/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records every delivery and answers with the next status in
+// statuses, then 200.
+func receiver(t *testing.T, statuses ...int) (*httptest.Server, func() []delivery) {
+	var mu sync.Mutex
+	var got []delivery
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, delivery{header: r.Header, body: body})
+		if len(got) <= len(statuses) {
+			w.WriteHeader(statuses[len(got)-1])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []delivery {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]delivery(nil), got...)
+	}
+}
+
+// newSender is webhook.New with a client that may reach the receivers,
+// which listen on loopback.
+func newSender(opts ...webhook.Option) *webhook.Sender {
+	return webhook.New("secret", zap.NewNop(), append([]webhook.Option{webhook.WithClient(http.DefaultClient)}, opts...)...)
+}
+
+func message() store.Message {
+	done := time.Unix(1700000001, 0)
+	return store.Message{
+		ID:          "msg-1",
+		Content:     "q",
+		Answer:      "a",
+		Status:      store.StatusCompleted,
+		Usage:       llm.Usage{TotalTokens: 7},
+		Outputs:     []store.Output{{Stage: "agents", Agent: "llm-1", Content: "a"}},
+		CreatedAt:   time.Unix(1700000000, 0),
+		CompletedAt: &done,
+	}
+}
+
+func TestSender_Send(t *testing.T) {
+	srv, deliveries := receiver(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	s := newSender(webhook.WithRetries(3, time.Millisecond, time.Millisecond))
+
+	require.NoError(t, s.Send(context.Background(), srv.URL, webhook.NewPayload(message())))
+
+	got := deliveries()
+	require.Len(t, got, 3)
+	for _, d := range got {
+		require.Equal(t, got[0].header.Get(webhook.DeliveryHeader), d.header.Get(webhook.DeliveryHeader))
+		require.True(t, webhook.Verify(
+			[]byte("secret"), d.header.Get(webhook.TimestampHeader), d.body, d.header.Get(webhook.SignatureHeader),
+		))
+	}
+	require.False(t, webhook.Verify(
+		[]byte("other"), got[0].header.Get(webhook.TimestampHeader), got[0].body, got[0].header.Get(webhook.SignatureHeader),
+	))
+
+	var p webhook.Payload
+	require.NoError(t, json.Unmarshal(got[2].body, &p))
+	require.Equal(t, webhook.EventCompleted, p.Event)
+	require.Equal(t, "a", p.Answer)
+	require.Equal(t, 7, p.Usage.TotalTokens)
+	require.Equal(t, "llm-1", p.Outputs[0].Agent)
+}
+
+func TestSender_DeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	retried, retriedDeliveries := receiver(t, 500, 500, 500)
+	rejected, rejectedDeliveries := receiver(t, http.StatusBadRequest)
+	s := newSender(
+		webhook.WithRetries(3, time.Millisecond, time.Millisecond),
+		webhook.WithDeadLetterFile(path),
+	)
+
+	failed := message()
+	failed.Status, failed.Error, failed.ErrorClass = store.StatusFailed, "processing failed", "unknown"
+	require.Error(t, s.Send(context.Background(), retried.URL, webhook.NewPayload(failed)))
+	require.Len(t, retriedDeliveries(), 3)
+	// A rejected payload isn't sent again
+	require.Error(t, s.Send(context.Background(), rejected.URL, webhook.NewPayload(failed)))
+	require.Len(t, rejectedDeliveries(), 1)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var letters []webhook.DeadLetter
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var dl webhook.DeadLetter
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &dl))
+		letters = append(letters, dl)
+	}
+	require.Len(t, letters, 2)
+	require.Equal(t, 3, letters[0].Attempts)
+	require.Equal(t, retried.URL, letters[0].URL)
+	require.Equal(t, webhook.EventFailed, letters[0].Payload.Event)
+	require.Equal(t, 1, letters[1].Attempts)
+}
+
+func TestSender_DeliverAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	srv, deliveries := receiver(t)
+	s := newSender(webhook.WithDeadLetterFile(path))
+	s.Close()
+
+	s.Deliver(srv.URL, webhook.NewPayload(message()))
+	require.Empty(t, deliveries())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"delivery_id"`)
+}
+
+func TestSender_ForbiddenAddress(t *testing.T) {
+	srv, deliveries := receiver(t)
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	s := webhook.New("secret", zap.NewNop(), webhook.WithRetries(3, time.Millisecond, time.Millisecond))
+
+	for _, url := range []string{
+		srv.URL,
+		"http://localhost:" + port,
+		"http://[::ffff:127.0.0.1]:" + port,
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1",
+		"http://192.168.1.1",
+		"http://0.0.0.0:" + port,
+	} {
+		err := s.Send(context.Background(), url, webhook.NewPayload(message()))
+		require.ErrorIs(t, err, webhook.ErrForbiddenAddress, url)
+	}
+	require.Empty(t, deliveries())
+}